@@ -0,0 +1,111 @@
+package apperr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// define the kind of an error, which decides its http status
+type Kind int
+
+const (
+	Internal Kind = iota
+	Validation
+	NotFound
+	Conflict
+	Unavailable
+	TooManyRequests
+	Timeout
+)
+
+// define the error returned to the client, the code is machine-readable and the field is the offending one
+type Error struct {
+	Kind       Kind           `json:"-"`
+	Code       string         `json:"code"`
+	Message    string         `json:"message"`
+	Field      string         `json:"field,omitempty"`
+	Violations []Violation    `json:"violations,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+	Err        error          `json:"-"`
+}
+
+// define one invalid field of a request, a validation error may report many of them at once
+type Violation struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// map the kind of the error to a http status
+func (e *Error) Status() int {
+	switch e.Kind {
+	case Validation:
+		return http.StatusBadRequest
+	case NotFound:
+		return http.StatusNotFound
+	case Conflict:
+		return http.StatusConflict
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	case TooManyRequests:
+		return http.StatusTooManyRequests
+	case Timeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// establish an error of the given kind
+func New(kind Kind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// establish a validation error on the offending field
+func NewValidation(field, code, message string) *Error {
+	return &Error{Kind: Validation, Code: code, Message: message, Field: field}
+}
+
+// establish a validation error reporting every violation, the first one is also the offending field
+func NewViolations(violations []Violation) *Error {
+	first := violations[0]
+	return &Error{Kind: Validation, Code: first.Code, Message: first.Message, Field: first.Field, Violations: violations}
+}
+
+// establish an error of the given kind caused by another error
+func Wrap(kind Kind, code, message string, err error) *Error {
+	return &Error{Kind: kind, Code: code, Message: message, Err: err}
+}
+
+// attach the details, such as the current counts of an exceeded limit, to the error
+func (e *Error) WithDetails(details map[string]any) *Error {
+	e.Details = details
+	return e
+}
+
+// find the typed error in the chain, a deadline hit or a canceled request is told apart, any other error is an internal one
+func From(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, context.DeadlineExceeded):
+		return Wrap(Timeout, "timeout", "the request timed out", err)
+	case errors.Is(err, context.Canceled):
+		return Wrap(Unavailable, "canceled", "the request is canceled", err)
+	default:
+		return Wrap(Internal, "internal", "internal server error", err)
+	}
+}
@@ -0,0 +1,88 @@
+package apperr_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"dcard/apperr"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// test every kind is mapped to its http status
+func TestError_Status(t *testing.T) {
+	assert.Equal(t, http.StatusBadRequest, apperr.New(apperr.Validation, "invalid", "invalid").Status())
+	assert.Equal(t, http.StatusNotFound, apperr.New(apperr.NotFound, "not_found", "not found").Status())
+	assert.Equal(t, http.StatusConflict, apperr.New(apperr.Conflict, "conflict", "conflict").Status())
+	assert.Equal(t, http.StatusServiceUnavailable, apperr.New(apperr.Unavailable, "unavailable", "unavailable").Status())
+	assert.Equal(t, http.StatusTooManyRequests, apperr.New(apperr.TooManyRequests, "too_many", "too many").Status())
+	assert.Equal(t, http.StatusGatewayTimeout, apperr.New(apperr.Timeout, "timeout", "timeout").Status())
+	assert.Equal(t, http.StatusInternalServerError, apperr.New(apperr.Internal, "internal", "internal").Status())
+}
+
+// test the typed error is found through wrapping
+func TestFrom(t *testing.T) {
+	cause := errors.New("connection refused")
+	e := apperr.Wrap(apperr.Unavailable, "store_unavailable", "the ad store is unavailable", cause)
+
+	// it is found through another wrapping error
+	found := apperr.From(fmt.Errorf("query: %w", e))
+	assert.Equal(t, e, found)
+	assert.True(t, errors.Is(found, cause))
+	assert.Equal(t, "the ad store is unavailable: connection refused", found.Error())
+
+	// any other error is an internal one
+	found = apperr.From(cause)
+	assert.Equal(t, apperr.Internal, found.Kind)
+	assert.Equal(t, http.StatusInternalServerError, found.Status())
+
+	// a deadline hit is a timeout and a canceled request is unavailable
+	found = apperr.From(fmt.Errorf("query: %w", context.DeadlineExceeded))
+	assert.Equal(t, apperr.Timeout, found.Kind)
+	assert.Equal(t, "timeout", found.Code)
+	found = apperr.From(fmt.Errorf("query: %w", context.Canceled))
+	assert.Equal(t, http.StatusServiceUnavailable, found.Status())
+	assert.Equal(t, "canceled", found.Code)
+}
+
+// test the json body only has the code, message and field
+func TestError_JSON(t *testing.T) {
+	e := apperr.NewValidation("limit", "out_of_range", "limit should be in this interval: [1, 100]")
+	body, err := json.Marshal(e)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"code":"out_of_range","message":"limit should be in this interval: [1, 100]","field":"limit"}`, string(body))
+
+	// the field is omitted when no field is offending
+	body, err = json.Marshal(apperr.Wrap(apperr.Internal, "internal", "internal server error", errors.New("secret")))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"code":"internal","message":"internal server error"}`, string(body))
+}
+
+// test every violation is reported, and the first one is the offending field
+func TestNewViolations(t *testing.T) {
+	e := apperr.NewViolations([]apperr.Violation{
+		{Field: "title", Code: "required", Message: "title is nil"},
+		{Field: "endAt", Code: "invalid_range", Message: "end time should be after start time"},
+	})
+	assert.Equal(t, http.StatusBadRequest, e.Status())
+	assert.Equal(t, "title", e.Field)
+	assert.Equal(t, "required", e.Code)
+
+	body, err := json.Marshal(e)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"code":"required","message":"title is nil","field":"title","violations":[
+		{"field":"title","code":"required","message":"title is nil"},
+		{"field":"endAt","code":"invalid_range","message":"end time should be after start time"}]}`, string(body))
+}
+
+// test the details are written in the json body
+func TestError_WithDetails(t *testing.T) {
+	e := apperr.New(apperr.TooManyRequests, "daily_quota_exceeded", "daily quota exceeded").WithDetails(map[string]any{"limit": 3000, "created": 3000})
+	body, err := json.Marshal(e)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"code":"daily_quota_exceeded","message":"daily quota exceeded","details":{"limit":3000,"created":3000}}`, string(body))
+}
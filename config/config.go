@@ -0,0 +1,377 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"dcard/logging"
+	"dcard/tracing"
+
+	"github.com/spf13/viper"
+)
+
+// define the settings of the server, they are read from the toml file, the ADS_* environment variables and the flags
+type Config struct {
+	Server  Server  `mapstructure:"server"`
+	Log     Log     `mapstructure:"log"`
+	MongoDB MongoDB `mapstructure:"mongodb"`
+	Quota   Quota   `mapstructure:"quota"`
+	Cache   Cache   `mapstructure:"cache"`
+	Tracing Tracing `mapstructure:"tracing"`
+	Timeout Timeout `mapstructure:"timeout"`
+}
+
+// define the listener of the server, tls is served when both the certificate and the key are set
+type Server struct {
+	Addr    string `mapstructure:"addr"`
+	Store   string `mapstructure:"store"`
+	TLSCert string `mapstructure:"tlscert"`
+	TLSKey  string `mapstructure:"tlskey"`
+	// the longest time to drain the requests in flight on shutdown
+	ShutdownTimeout time.Duration `mapstructure:"shutdowntimeout"`
+	// the time the failing readiness check is given to reach the load balancer before the listener is closed
+	DrainDelay time.Duration `mapstructure:"draindelay"`
+}
+
+// define where and what to log, the values of the redacted headers are never written
+type Log struct {
+	Path          string   `mapstructure:"path"`
+	Level         string   `mapstructure:"level"`
+	RedactHeaders []string `mapstructure:"redactheaders"`
+	// the file is rotated when it is larger than maxsize megabytes or older than maxage, a zero value is not enforced
+	MaxSize    int           `mapstructure:"maxsize"`
+	MaxAge     time.Duration `mapstructure:"maxage"`
+	MaxBackups int           `mapstructure:"maxbackups"`
+	Compress   bool          `mapstructure:"compress"`
+}
+
+// define the connection of mongodb, zero pool options keep the driver defaults
+type MongoDB struct {
+	URI                    string        `mapstructure:"uri"`
+	Database               string        `mapstructure:"database"`
+	Collection             string        `mapstructure:"collection"`
+	MaxPoolSize            uint64        `mapstructure:"maxpoolsize"`
+	MinPoolSize            uint64        `mapstructure:"minpoolsize"`
+	MaxConnIdleTime        time.Duration `mapstructure:"maxconnidletime"`
+	ConnectTimeout         time.Duration `mapstructure:"connecttimeout"`
+	ServerSelectionTimeout time.Duration `mapstructure:"serverselectiontimeout"`
+	// the idempotent operations are retried on a transient error, and the breaker fails them fast while mongodb is down
+	RetryAttempts    int           `mapstructure:"retryattempts"`
+	RetryBaseDelay   time.Duration `mapstructure:"retrybasedelay"`
+	RetryMaxDelay    time.Duration `mapstructure:"retrymaxdelay"`
+	BreakerThreshold int           `mapstructure:"breakerthreshold"`
+	BreakerCooldown  time.Duration `mapstructure:"breakercooldown"`
+}
+
+// define the limits on creating ads, a zero limit is not enforced
+type Quota struct {
+	DailyLimit  int `mapstructure:"dailylimit"`
+	ActiveLimit int `mapstructure:"activelimit"`
+}
+
+// define the in-memory snapshot answering the queries
+type Cache struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	RefreshInterval time.Duration `mapstructure:"refreshinterval"`
+	Watch           bool          `mapstructure:"watch"`
+	PollInterval    time.Duration `mapstructure:"pollinterval"`
+	Fallback        bool          `mapstructure:"fallback"`
+}
+
+// define where the spans are exported and how many of the traces are sampled
+type Tracing struct {
+	Exporter    string  `mapstructure:"exporter"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	File        string  `mapstructure:"file"`
+	SampleRatio float64 `mapstructure:"sampleratio"`
+	ServiceName string  `mapstructure:"servicename"`
+}
+
+// define the longest time each kind of store operation may take, a zero timeout only ends with the request
+type Timeout struct {
+	Query time.Duration `mapstructure:"query"`
+	Get   time.Duration `mapstructure:"get"`
+	Write time.Duration `mapstructure:"write"`
+	Usage time.Duration `mapstructure:"usage"`
+	Ready time.Duration `mapstructure:"ready"`
+	// connecting to mongodb, creating its indexes and loading the first snapshot of the cache when the server starts
+	Startup time.Duration `mapstructure:"startup"`
+}
+
+// the config file read when neither --config nor ADS_CONFIG is given
+const DefaultFile = "project.conf"
+
+// every setting with its default and usage, each of them can be overridden by ADS_<SECTION>_<KEY> and --<section>.<key>
+var settings = []struct {
+	key   string
+	value any
+	usage string
+}{
+	{"server.addr", ":8080", "the address the server listens on"},
+	{"server.store", "mongo", "the ad store backend: mongo or memory"},
+	{"server.tlscert", "", "the certificate file to serve https"},
+	{"server.tlskey", "", "the key file to serve https"},
+	{"server.shutdowntimeout", "15s", "the longest time to drain the requests in flight on shutdown"},
+	{"server.draindelay", "5s", "the time between failing the readiness check and closing the listener on shutdown"},
+	{"log.path", "server.log", "the file the log is written to"},
+	{"log.level", "info", "the lowest level logged: debug, info, warn or error"},
+	{"log.redactheaders", logging.DefaultRedactedHeaders, "the comma-separated headers whose values are never logged"},
+	{"log.maxsize", 100, "the megabytes the log file grows to before it is rotated, 0 is unlimited"},
+	{"log.maxage", "24h", "the time the log file is written before it is rotated, 0 is unlimited"},
+	{"log.maxbackups", 7, "the rotated log files kept, 0 keeps all"},
+	{"log.compress", true, "gzip the rotated log files"},
+	{"mongodb.uri", "mongodb://127.0.0.1:27017", "the uri of mongodb"},
+	{"mongodb.database", "dcard-ads", "the database of the ads"},
+	{"mongodb.collection", "ads", "the collection of the ads"},
+	{"mongodb.maxpoolsize", 100, "the most connections in the pool"},
+	{"mongodb.minpoolsize", 0, "the least connections in the pool"},
+	{"mongodb.maxconnidletime", "0s", "the longest time a connection stays idle in the pool"},
+	{"mongodb.connecttimeout", "10s", "the timeout of connecting to mongodb"},
+	{"mongodb.serverselectiontimeout", "5s", "the timeout of selecting a mongodb server"},
+	{"mongodb.retryattempts", 3, "the attempts of a read or an idempotent write on a transient error, 0 or 1 never retries"},
+	{"mongodb.retrybasedelay", "50ms", "the backoff before the first retry, it doubles for each retry with jitter"},
+	{"mongodb.retrymaxdelay", "1s", "the longest backoff before a retry"},
+	{"mongodb.breakerthreshold", 5, "the consecutive failures which open the circuit breaker, 0 never opens it"},
+	{"mongodb.breakercooldown", "10s", "how long the circuit breaker stays open before probing mongodb again"},
+	{"quota.dailylimit", 3000, "the ads which can be created per day, 0 is unlimited"},
+	{"quota.activelimit", 1000, "the ads which can be active at the same time, 0 is unlimited"},
+	{"cache.enabled", false, "answer the queries from an in-memory snapshot"},
+	{"cache.refreshinterval", "5s", "the interval of reloading the snapshot"},
+	{"cache.watch", false, "apply the writes of the other servers to the snapshot"},
+	{"cache.pollinterval", "2s", "the interval of reloading when change streams are not supported"},
+	{"cache.fallback", false, "answer from the last snapshot when it can not be reloaded because the store is down"},
+	{"tracing.exporter", tracing.ExporterNone, "the exporter of the spans: none, otlp, stdout or file"},
+	{"tracing.endpoint", "", "the url of the otlp/http collector, empty uses OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318"},
+	{"tracing.file", "traces.json", "the file the file exporter appends the spans to"},
+	{"tracing.sampleratio", 1.0, "the ratio of the new traces sampled, from 0 to 1"},
+	{"tracing.servicename", "dcard-ads", "the service name of the spans"},
+	{"timeout.query", "2s", "the longest time to query a page of ads, 0 only ends with the request"},
+	{"timeout.get", "1s", "the longest time to get an ad, 0 only ends with the request"},
+	{"timeout.write", "3s", "the longest time to create, replace, change or delete an ad, 0 only ends with the request"},
+	{"timeout.usage", "2s", "the longest time to count the usage of the quota, 0 only ends with the request"},
+	{"timeout.ready", "1s", "the longest time to check the store for the readiness check, 0 only ends with the request"},
+	{"timeout.startup", "30s", "the longest time to connect to the store and load the cache on start, 0 is unlimited"},
+}
+
+// load the config from the command-line arguments, the file is given by --config or ADS_CONFIG
+func Load(args []string) (*Config, error) {
+	path := DefaultFile
+	if env := os.Getenv("ADS_CONFIG"); env != "" {
+		path = env
+	}
+
+	flags := flag.NewFlagSet("ads", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	configFile := flags.String("config", path, "the toml config file")
+	store := flags.String("store", "", "the same as --server.store")
+	values := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		values[s.key] = flags.String(s.key, "", fmt.Sprintf("%s (default %v)", s.usage, s.value))
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			flags.SetOutput(os.Stderr)
+			flags.PrintDefaults()
+		}
+		return nil, fmt.Errorf("parse flags: %w", err)
+	}
+
+	// only the flags given on the command line override the file
+	overrides := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config":
+		case "store":
+			overrides["server.store"] = *store
+		default:
+			overrides[f.Name] = *values[f.Name]
+		}
+	})
+	return LoadFile(*configFile, overrides)
+}
+
+// load the config from the file and the environment variables, the overrides are applied last
+func LoadFile(path string, overrides map[string]string) (*Config, error) {
+	v := viper.New()
+	for _, s := range settings {
+		v.SetDefault(s.key, s.value)
+	}
+	v.SetConfigType("toml")
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("read config file %s: %w", path, err)
+	}
+	v.SetEnvPrefix("ADS")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for key, value := range overrides {
+		v.Set(key, value)
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// check every setting, and report all the invalid ones at once
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		invalid("server.addr", "should be host:port like \":8080\", got %q", c.Server.Addr)
+	}
+	if c.Server.Store != "mongo" && c.Server.Store != "memory" {
+		invalid("server.store", "should be mongo or memory, got %q", c.Server.Store)
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		invalid("server.tlscert", "should be set together with server.tlskey")
+	}
+	for _, f := range []struct{ key, file string }{{"server.tlscert", c.Server.TLSCert}, {"server.tlskey", c.Server.TLSKey}} {
+		if f.file == "" {
+			continue
+		}
+		if _, err := os.Stat(f.file); err != nil {
+			invalid(f.key, "can not read %q: %v", f.file, err)
+		}
+	}
+
+	if c.Log.Path == "" {
+		invalid("log.path", "should not be empty")
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		invalid("log.level", "should be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	if c.Log.MaxSize < 0 {
+		invalid("log.maxsize", "should not be negative, got %d", c.Log.MaxSize)
+	}
+	if c.Log.MaxBackups < 0 {
+		invalid("log.maxbackups", "should not be negative, got %d", c.Log.MaxBackups)
+	}
+
+	// mongodb is only needed when it is the store
+	if c.Server.Store == "mongo" {
+		if !strings.HasPrefix(c.MongoDB.URI, "mongodb://") && !strings.HasPrefix(c.MongoDB.URI, "mongodb+srv://") {
+			invalid("mongodb.uri", "should start with mongodb:// or mongodb+srv://, got %q", c.MongoDB.URI)
+		}
+		if c.MongoDB.Database == "" {
+			invalid("mongodb.database", "should not be empty")
+		}
+		if c.MongoDB.Collection == "" {
+			invalid("mongodb.collection", "should not be empty")
+		}
+	}
+	if c.MongoDB.RetryAttempts < 0 {
+		invalid("mongodb.retryattempts", "should not be negative, got %d", c.MongoDB.RetryAttempts)
+	}
+	if c.MongoDB.BreakerThreshold < 0 {
+		invalid("mongodb.breakerthreshold", "should not be negative, got %d", c.MongoDB.BreakerThreshold)
+	}
+	if c.MongoDB.MaxPoolSize != 0 && c.MongoDB.MinPoolSize > c.MongoDB.MaxPoolSize {
+		invalid("mongodb.minpoolsize", "should not be larger than mongodb.maxpoolsize %d, got %d", c.MongoDB.MaxPoolSize, c.MongoDB.MinPoolSize)
+	}
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"server.shutdowntimeout", c.Server.ShutdownTimeout},
+		{"server.draindelay", c.Server.DrainDelay},
+		{"log.maxage", c.Log.MaxAge},
+		{"mongodb.maxconnidletime", c.MongoDB.MaxConnIdleTime},
+		{"mongodb.connecttimeout", c.MongoDB.ConnectTimeout},
+		{"mongodb.serverselectiontimeout", c.MongoDB.ServerSelectionTimeout},
+		{"mongodb.retrybasedelay", c.MongoDB.RetryBaseDelay},
+		{"mongodb.retrymaxdelay", c.MongoDB.RetryMaxDelay},
+		{"mongodb.breakercooldown", c.MongoDB.BreakerCooldown},
+		{"cache.refreshinterval", c.Cache.RefreshInterval},
+		{"cache.pollinterval", c.Cache.PollInterval},
+		{"timeout.query", c.Timeout.Query},
+		{"timeout.get", c.Timeout.Get},
+		{"timeout.write", c.Timeout.Write},
+		{"timeout.usage", c.Timeout.Usage},
+		{"timeout.ready", c.Timeout.Ready},
+		{"timeout.startup", c.Timeout.Startup},
+	} {
+		if d.value < 0 {
+			invalid(d.key, "should not be negative, got %s", d.value)
+		}
+	}
+
+	if c.Quota.DailyLimit < 0 {
+		invalid("quota.dailylimit", "should not be negative, got %d", c.Quota.DailyLimit)
+	}
+	if c.Quota.ActiveLimit < 0 {
+		invalid("quota.activelimit", "should not be negative, got %d", c.Quota.ActiveLimit)
+	}
+
+	// the fallback answers from the snapshot of the cache
+	if c.Cache.Fallback && !c.Cache.Enabled {
+		invalid("cache.fallback", "needs cache.enabled")
+	}
+
+	switch c.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout:
+	case tracing.ExporterOTLP:
+		if c.Tracing.Endpoint != "" {
+			if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				invalid("tracing.endpoint", "should be a url like \"http://localhost:4318\", got %q", c.Tracing.Endpoint)
+			}
+		}
+	case tracing.ExporterFile:
+		if c.Tracing.File == "" {
+			invalid("tracing.file", "should not be empty for the file exporter")
+		}
+	default:
+		invalid("tracing.exporter", "should be none, otlp, stdout or file, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sampleratio", "should be in [0, 1], got %v", c.Tracing.SampleRatio)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+}
+
+// the rotation of the log file in the options of the logging package
+func (l Log) Rotate() logging.RotateOptions {
+	return logging.RotateOptions{
+		MaxSize:    int64(l.MaxSize) << 20,
+		MaxAge:     l.MaxAge,
+		MaxBackups: l.MaxBackups,
+		Compress:   l.Compress,
+	}
+}
+
+// the tracing in the options of the tracing package
+func (t Tracing) Options() tracing.Options {
+	return tracing.Options{
+		Exporter:    t.Exporter,
+		Endpoint:    t.Endpoint,
+		File:        t.File,
+		SampleRatio: t.SampleRatio,
+		ServiceName: t.ServiceName,
+	}
+}
+
+// check if the server should serve https
+func (s Server) TLS() bool {
+	return s.TLSCert != "" && s.TLSKey != ""
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dcard/logging"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// write the config file into the temporary directory of the test
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "test.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// test the settings are read from the file
+func TestLoadFile(t *testing.T) {
+	cfg, err := LoadFile("../storage/test.conf", nil)
+	if err != nil {
+		t.Fatalf("LoadFile returned an error: %v", err)
+	}
+	assert.Equal(t, MongoDB{
+		URI:                    "mongodb://127.0.0.1:27017",
+		Database:               "testdatabase",
+		Collection:             "testcollection",
+		MaxPoolSize:            20,
+		MinPoolSize:            0,
+		MaxConnIdleTime:        time.Minute,
+		ConnectTimeout:         2 * time.Second,
+		ServerSelectionTimeout: 2 * time.Second,
+		RetryAttempts:          3,
+		RetryBaseDelay:         50 * time.Millisecond,
+		RetryMaxDelay:          time.Second,
+		BreakerThreshold:       5,
+		BreakerCooldown:        10 * time.Second,
+	}, cfg.MongoDB)
+	assert.Equal(t, Quota{DailyLimit: 30, ActiveLimit: 10}, cfg.Quota)
+	assert.Equal(t, Cache{Enabled: true, RefreshInterval: time.Second, Watch: true, PollInterval: 100 * time.Millisecond}, cfg.Cache)
+
+	// the sections missing in the file keep the defaults
+	assert.Equal(t, Server{Addr: ":8080", Store: "mongo", ShutdownTimeout: 15 * time.Second, DrainDelay: 5 * time.Second}, cfg.Server)
+	assert.Equal(t, Log{Path: "server.log", Level: "info", RedactHeaders: logging.DefaultRedactedHeaders, MaxSize: 100, MaxAge: 24 * time.Hour, MaxBackups: 7, Compress: true}, cfg.Log)
+	assert.Equal(t, logging.RotateOptions{MaxSize: 100 << 20, MaxAge: 24 * time.Hour, MaxBackups: 7, Compress: true}, cfg.Log.Rotate())
+	assert.False(t, cfg.Server.TLS())
+	assert.Equal(t, Tracing{Exporter: "none", File: "traces.json", SampleRatio: 1, ServiceName: "dcard-ads"}, cfg.Tracing)
+	assert.Equal(t, Timeout{Query: 2 * time.Second, Get: time.Second, Write: 3 * time.Second, Usage: 2 * time.Second, Ready: time.Second, Startup: 30 * time.Second}, cfg.Timeout)
+
+	// the config of the project is valid as well
+	_, err = LoadFile("../project.conf", nil)
+	assert.NoError(t, err)
+
+	// a missing config file should return an error
+	_, err = LoadFile("not-exist.conf", nil)
+	assert.Error(t, err)
+}
+
+// test the environment variables override the file, and the flags override both
+func TestLoad_Overrides(t *testing.T) {
+	path := writeConfig(t, `
+[server]
+addr=":8080"
+store="mongo"
+[quota]
+dailylimit=100
+activelimit=10
+`)
+	t.Setenv("ADS_CONFIG", path)
+	t.Setenv("ADS_SERVER_ADDR", ":9090")
+	t.Setenv("ADS_QUOTA_DAILYLIMIT", "200")
+	t.Setenv("ADS_CACHE_REFRESHINTERVAL", "3s")
+	t.Setenv("ADS_LOG_REDACTHEADERS", "Authorization,X-Secret")
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load returned an error: %v", err)
+	}
+	assert.Equal(t, ":9090", cfg.Server.Addr)
+	assert.Equal(t, 200, cfg.Quota.DailyLimit)
+	assert.Equal(t, 10, cfg.Quota.ActiveLimit)
+	assert.Equal(t, 3*time.Second, cfg.Cache.RefreshInterval)
+	assert.Equal(t, []string{"Authorization", "X-Secret"}, cfg.Log.RedactHeaders)
+
+	cfg, err = Load([]string{"--server.addr=127.0.0.1:7070", "--quota.dailylimit", "300", "--store=memory", "--cache.enabled=true", "--log.redactheaders=Cookie"})
+	if err != nil {
+		t.Fatalf("Load returned an error: %v", err)
+	}
+	assert.Equal(t, "127.0.0.1:7070", cfg.Server.Addr)
+	assert.Equal(t, "memory", cfg.Server.Store)
+	assert.Equal(t, 300, cfg.Quota.DailyLimit)
+	assert.Equal(t, 10, cfg.Quota.ActiveLimit)
+	assert.True(t, cfg.Cache.Enabled)
+	assert.Equal(t, []string{"Cookie"}, cfg.Log.RedactHeaders)
+}
+
+// test --config is preferred to ADS_CONFIG
+func TestLoad_ConfigFlag(t *testing.T) {
+	t.Setenv("ADS_CONFIG", "not-exist.conf")
+	path := writeConfig(t, "[server]\naddr=\":6060\"\n[log]\nredactheaders=[\"X-Token\"]\n")
+
+	cfg, err := Load([]string{"--config", path})
+	if err != nil {
+		t.Fatalf("Load returned an error: %v", err)
+	}
+	assert.Equal(t, ":6060", cfg.Server.Addr)
+	assert.Equal(t, []string{"X-Token"}, cfg.Log.RedactHeaders)
+
+	_, err = Load(nil)
+	assert.Error(t, err)
+}
+
+// test the unknown flags and the values of a wrong type are rejected
+func TestLoad_BadArgs(t *testing.T) {
+	path := writeConfig(t, "")
+
+	_, err := Load([]string{"--config", path, "--not-exist=1"})
+	assert.Error(t, err)
+
+	_, err = Load([]string{"--config", path, "--quota.dailylimit=many"})
+	assert.Error(t, err)
+}
+
+// test every invalid setting is reported at once
+func TestValidate(t *testing.T) {
+	path := writeConfig(t, `
+[server]
+addr="8080"
+store="redis"
+tlscert="cert.pem"
+[log]
+path=""
+level="verbose"
+[quota]
+dailylimit=-1
+`)
+	_, err := LoadFile(path, nil)
+	if !assert.Error(t, err) {
+		return
+	}
+	for _, key := range []string{"server.addr", "server.store", "server.tlscert", "log.path", "log.level", "quota.dailylimit"} {
+		assert.Contains(t, err.Error(), key+":")
+	}
+	assert.True(t, strings.HasPrefix(err.Error(), "invalid config:"))
+
+	// mongodb is not checked for the in-memory store
+	path = writeConfig(t, "[server]\nstore=\"memory\"\n[mongodb]\nuri=\"\"\n")
+	_, err = LoadFile(path, nil)
+	assert.NoError(t, err)
+
+	_, err = LoadFile(path, map[string]string{"server.store": "mongo"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mongodb.uri:")
+	}
+
+	_, err = LoadFile(path, map[string]string{"mongodb.minpoolsize": "10", "mongodb.maxpoolsize": "5", "cache.pollinterval": "-1s", "server.shutdowntimeout": "-1s", "server.draindelay": "-1s", "log.maxsize": "-1", "log.maxage": "-1h", "log.maxbackups": "-1", "timeout.query": "-1s", "timeout.startup": "-1s", "mongodb.retryattempts": "-1", "mongodb.breakercooldown": "-1s"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "log.maxsize:")
+		assert.Contains(t, err.Error(), "log.maxage:")
+		assert.Contains(t, err.Error(), "log.maxbackups:")
+		assert.Contains(t, err.Error(), "mongodb.minpoolsize:")
+		assert.Contains(t, err.Error(), "server.shutdowntimeout:")
+		assert.Contains(t, err.Error(), "server.draindelay:")
+		assert.Contains(t, err.Error(), "cache.pollinterval:")
+		assert.Contains(t, err.Error(), "timeout.query:")
+		assert.Contains(t, err.Error(), "timeout.startup:")
+		assert.Contains(t, err.Error(), "mongodb.retryattempts:")
+		assert.Contains(t, err.Error(), "mongodb.breakercooldown:")
+	}
+
+	// the fallback answers from the snapshot of the cache
+	_, err = LoadFile(path, map[string]string{"cache.fallback": "true"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cache.fallback:")
+	}
+	_, err = LoadFile(path, map[string]string{"cache.fallback": "true", "cache.enabled": "true"})
+	assert.NoError(t, err)
+
+	_, err = LoadFile(path, map[string]string{"tracing.exporter": "zipkin", "tracing.sampleratio": "1.5"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tracing.exporter:")
+		assert.Contains(t, err.Error(), "tracing.sampleratio:")
+	}
+
+	_, err = LoadFile(path, map[string]string{"tracing.exporter": "otlp", "tracing.endpoint": "localhost:4318"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tracing.endpoint:")
+	}
+
+	_, err = LoadFile(path, map[string]string{"tracing.exporter": "file", "tracing.file": ""})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tracing.file:")
+	}
+}
+
+// test https is served only when both the certificate and the key are readable
+func TestValidate_TLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for _, file := range []string{cert, key} {
+		if err := os.WriteFile(file, []byte("test"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := writeConfig(t, "[server]\nstore=\"memory\"\n")
+
+	cfg, err := LoadFile(path, map[string]string{"server.tlscert": cert, "server.tlskey": key})
+	if assert.NoError(t, err) {
+		assert.True(t, cfg.Server.TLS())
+	}
+
+	_, err = LoadFile(path, map[string]string{"server.tlscert": cert, "server.tlskey": filepath.Join(dir, "not-exist.pem")})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "server.tlskey:")
+	}
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// the value written in place of a redacted header
+const Redacted = "[REDACTED]"
+
+// the headers redacted when nothing is configured
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// the canonical names of the redacted headers, replaced as a whole
+var redacted atomic.Pointer[map[string]bool]
+
+func init() {
+	SetRedactedHeaders(DefaultRedactedHeaders)
+}
+
+// parse the level in the config, an unknown level is info
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// establish a logger writing json lines at or above the level
+func New(w io.Writer, level string) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: ParseLevel(level)}))
+}
+
+// make the json logger the default one, the lines of the standard log package are written through it at info
+func Setup(w io.Writer, level string, redactHeaders []string) *slog.Logger {
+	logger := New(w, level)
+	slog.SetDefault(logger)
+	SetRedactedHeaders(redactHeaders)
+	return logger
+}
+
+// replace the headers whose values are never written to the log, the names are case-insensitive
+func SetRedactedHeaders(names []string) {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+	redacted.Store(&set)
+}
+
+// log the headers as a group, with the values of the sensitive ones redacted
+func Headers(headers map[string][]string) slog.Attr {
+	set := *redacted.Load()
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]any, 0, len(headers))
+	for _, key := range keys {
+		vals := headers[key]
+		if set[http.CanonicalHeaderKey(key)] {
+			attrs = append(attrs, slog.String(key, Redacted))
+			continue
+		}
+		attrs = append(attrs, slog.Any(key, vals))
+	}
+	return slog.Group("headers", attrs...)
+}
+
+type loggerKey struct{}
+
+// attach the logger of the request to the context
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// get the logger of the request, or the default logger outside of a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// use a json logger writing to the buffer as the default one during the test
+func captureLog(t *testing.T, level string) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(New(&buf, level))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// decode every json line in the buffer
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	lines := make([]map[string]any, 0)
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var line map[string]any
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// test parselevel
+func TestParseLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelDebug, ParseLevel("debug"))
+	assert.Equal(t, slog.LevelInfo, ParseLevel("info"))
+	assert.Equal(t, slog.LevelWarn, ParseLevel("WARN"))
+	assert.Equal(t, slog.LevelError, ParseLevel("error"))
+	assert.Equal(t, slog.LevelInfo, ParseLevel("verbose"))
+}
+
+// test the lines below the level are dropped
+func TestNew_Level(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "warn")
+	logger.Info("GET item")
+	logger.Warn("Fail to refresh the ad cache")
+
+	lines := logLines(t, &buf)
+	if assert.Equal(t, 1, len(lines)) {
+		assert.Equal(t, "WARN", lines[0]["level"])
+		assert.Equal(t, "Fail to refresh the ad cache", lines[0]["msg"])
+	}
+}
+
+// test the values of the sensitive headers are redacted whatever their case
+func TestHeaders(t *testing.T) {
+	t.Cleanup(func() { SetRedactedHeaders(DefaultRedactedHeaders) })
+	headers := map[string][]string{
+		"Authorization": {"Bearer secret"},
+		"cookie":        {"session=secret"},
+		"X-Secret":      {"secret"},
+		"User-Agent":    {"curl/7.88.1"},
+	}
+
+	var buf bytes.Buffer
+	New(&buf, "info").Info("POST ad", Headers(headers))
+	assert.NotContains(t, buf.String(), "Bearer secret")
+	assert.NotContains(t, buf.String(), "session=secret")
+	assert.Contains(t, buf.String(), `"X-Secret":["secret"]`)
+	assert.Contains(t, buf.String(), `"User-Agent":["curl/7.88.1"]`)
+
+	// the list can be configured
+	SetRedactedHeaders([]string{"x-secret "})
+	buf.Reset()
+	New(&buf, "info").Info("POST ad", Headers(headers))
+	assert.Contains(t, buf.String(), `"Authorization":["Bearer secret"]`)
+	assert.Contains(t, buf.String(), `"X-Secret":"[REDACTED]"`)
+}
+
+// test fromcontext falls back to the default logger
+func TestFromContext(t *testing.T) {
+	buf := captureLog(t, "info")
+	FromContext(context.Background()).Info("GET usage")
+	FromContext(WithLogger(context.Background(), slog.Default().With("request_id", "abc"))).Info("GET usage")
+
+	lines := logLines(t, buf)
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Nil(t, lines[0]["request_id"])
+		assert.Equal(t, "abc", lines[1]["request_id"])
+	}
+}
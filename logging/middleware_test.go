@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// establish a router whose handler logs through the logger of the request
+func newTestRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/test-log/:id", func(c *gin.Context) {
+		FromContext(c.Request.Context()).Info("GET ad", "id", c.Param("id"))
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+// serve a request with the request id and return the recorder
+func serveWithID(router *gin.Engine, url, id string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	if id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// test the request id from the client is attached to the response and every log line
+func TestMiddleware_Propagate(t *testing.T) {
+	buf := captureLog(t, "info")
+	recorder := serveWithID(newTestRouter(), "/test-log/1", "abc-123")
+	assert.Equal(t, "abc-123", recorder.Header().Get(RequestIDHeader))
+
+	lines := logLines(t, buf)
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Equal(t, "GET ad", lines[0]["msg"])
+		assert.Equal(t, "abc-123", lines[0]["request_id"])
+		assert.Equal(t, "http request", lines[1]["msg"])
+		assert.Equal(t, "abc-123", lines[1]["request_id"])
+		assert.Equal(t, "/test-log/:id", lines[1]["route"])
+		assert.Equal(t, float64(http.StatusOK), lines[1]["status"])
+	}
+}
+
+// test a request id is generated when the client gives none or an unsafe one
+func TestMiddleware_Generate(t *testing.T) {
+	buf := captureLog(t, "info")
+	router := newTestRouter()
+	for _, id := range []string{"", "abc 123\n{\"level\":\"ERROR\"}", strings.Repeat("a", maxRequestIDLength+1)} {
+		recorder := serveWithID(router, "/test-log/1", id)
+		generated := recorder.Header().Get(RequestIDHeader)
+		assert.Equal(t, 32, len(generated))
+		assert.NotEqual(t, id, generated)
+	}
+
+	// every request gets its own id
+	lines := logLines(t, buf)
+	ids := make(map[any]bool)
+	for _, line := range lines {
+		ids[line["request_id"]] = true
+	}
+	assert.Equal(t, 3, len(ids))
+
+	// the requests matching no route share one label
+	serveWithID(router, "/not-exist", "")
+	lines = logLines(t, buf)
+	if assert.Equal(t, 1, len(lines)) {
+		assert.Equal(t, "unmatched", lines[0]["route"])
+	}
+}
+
+// test the lines logged for a traced request carry its trace id and span id
+func TestMiddleware_Trace(t *testing.T) {
+	buf := captureLog(t, "info")
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	router := gin.New()
+	// stand in for the tracing middleware, which starts the span before
+	router.Use(func(c *gin.Context) {
+		span := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+		c.Request = c.Request.WithContext(trace.ContextWithSpanContext(c.Request.Context(), span))
+	}, Middleware())
+	router.GET("/test-log/:id", func(c *gin.Context) {
+		FromContext(c.Request.Context()).Info("GET ad", "id", c.Param("id"))
+		c.Status(http.StatusOK)
+	})
+
+	serveWithID(router, "/test-log/1", "")
+	lines := logLines(t, buf)
+	if assert.Equal(t, 2, len(lines)) {
+		for _, line := range lines {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", line["trace_id"])
+			assert.Equal(t, "00f067aa0ba902b7", line["span_id"])
+		}
+	}
+
+	// an untraced request has no trace id
+	serveWithID(newTestRouter(), "/test-log/1", "")
+	lines = logLines(t, buf)
+	if assert.Equal(t, 2, len(lines)) {
+		assert.NotContains(t, lines[0], "trace_id")
+	}
+}
+
+// test validrequestid
+func TestValidRequestID(t *testing.T) {
+	assert.True(t, validRequestID("abc-123_4.5:6"))
+	assert.True(t, validRequestID(strings.Repeat("a", maxRequestIDLength)))
+	assert.False(t, validRequestID(""))
+	assert.False(t, validRequestID("abc 123"))
+	assert.False(t, validRequestID("abc\n123"))
+	assert.False(t, validRequestID(strings.Repeat("a", maxRequestIDLength+1)))
+}
@@ -0,0 +1,323 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the time in the name of a rotated file, a counter follows it when several files are rotated in the same millisecond
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// a rotated file of the log, the time and the counter in its name sort the files in the order of rotation
+type backup struct {
+	name    string
+	at      time.Time
+	counter int
+}
+
+// define when the log file is rotated and how many rotated files are kept, a zero value disables the limit
+type RotateOptions struct {
+	// rotate before a write would make the file larger than this many bytes
+	MaxSize int64
+	// rotate when the file has been written for this long since it was started, a restart does not reset the age
+	MaxAge time.Duration
+	// the rotated files kept, the oldest ones are removed
+	MaxBackups int
+	// gzip the rotated files
+	Compress bool
+}
+
+// define a log file which is rotated by size and age, it can be reopened when it is moved by an external logrotate
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+	now  func() time.Time
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	startedAt time.Time
+
+	// the rotated files are compressed and pruned one at a time in background
+	millMu sync.Mutex
+	wg     sync.WaitGroup
+}
+
+var _ io.WriteCloser = (*RotatingFile)(nil)
+
+// open the log file for appending, it is created with its directory when missing
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, opts: opts, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open the file at the path, a file moved away by logrotate is created again
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.startedAt = file, info.Size(), f.now()
+	if info.Size() > 0 {
+		f.startedAt = f.started(info)
+	}
+	return nil
+}
+
+// get the time a file with lines was started, it is the time of the newest rotation, and the last write when
+// the file was never rotated or was moved by an external logrotate since
+func (f *RotatingFile) started(info os.FileInfo) time.Time {
+	backups, err := f.rotated()
+	if err != nil || len(backups) == 0 || backups[0].at.After(info.ModTime()) {
+		return info.ModTime()
+	}
+	return backups[0].at
+}
+
+// write a log line, the file is rotated first when the line would exceed the size or the file is too old
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// check if the file should be rotated before the next write, an empty file is never rotated
+func (f *RotatingFile) shouldRotate(next int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.opts.MaxSize > 0 && f.size+int64(next) > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.MaxAge > 0 && f.now().Sub(f.startedAt) >= f.opts.MaxAge
+}
+
+// rename the file with the time of rotation and start a new one, the rotated files are compressed and pruned in background
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	backup := f.backupName(f.now())
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.millMu.Lock()
+		defer f.millMu.Unlock()
+		if f.opts.Compress {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintln(os.Stderr, "Fail to compress the rotated log:", err)
+			}
+		}
+		if err := f.prune(); err != nil {
+			fmt.Fprintln(os.Stderr, "Fail to remove the old logs:", err)
+		}
+	}()
+	return nil
+}
+
+// name the rotated file after the time of rotation, a counter is added when a file of the same millisecond exists
+// so the rename never overwrites it
+func (f *RotatingFile) backupName(at time.Time) string {
+	ext := filepath.Ext(f.path)
+	base := fmt.Sprintf("%s-%s", strings.TrimSuffix(f.path, ext), at.UTC().Format(backupTimeFormat))
+	name := base + ext
+	for i := 1; fileExists(name) || fileExists(name+".gz"); i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return name
+}
+
+// check if anything is at the path
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// rotate the file now
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	return f.rotate()
+}
+
+// close the file and open the path again, so the lines are written to the new file after an external logrotate moved the old one
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		f.file = nil
+	}
+	return f.open()
+}
+
+// close the file after the rotated files are compressed
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wg.Wait()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// list the paths of the rotated files of the log from the newest to the oldest
+func (f *RotatingFile) backups() ([]string, error) {
+	rotated, err := f.rotated()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(rotated))
+	for i, backup := range rotated {
+		paths[i] = filepath.Join(filepath.Dir(f.path), backup.name)
+	}
+	return paths, nil
+}
+
+// list the rotated files of the log from the newest to the oldest
+func (f *RotatingFile) rotated() ([]backup, error) {
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(filepath.Base(f.path), ext) + "-"
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]backup, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		if b, ok := parseBackupStamp(stamp); ok {
+			b.name = name
+			backups = append(backups, b)
+		}
+	}
+	// a compressed file sorts the same as its source
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].at.Equal(backups[j].at) {
+			return backups[i].at.After(backups[j].at)
+		}
+		return backups[i].counter > backups[j].counter
+	})
+	return backups, nil
+}
+
+// parse the time and the counter in the name of a rotated file, like 2024-03-13T08-00-01.000 or 2024-03-13T08-00-01.000-1
+func parseBackupStamp(stamp string) (backup, bool) {
+	if len(stamp) < len(backupTimeFormat) {
+		return backup{}, false
+	}
+	at, err := time.Parse(backupTimeFormat, stamp[:len(backupTimeFormat)])
+	if err != nil {
+		return backup{}, false
+	}
+	rest := stamp[len(backupTimeFormat):]
+	if rest == "" {
+		return backup{at: at}, true
+	}
+	counter, err := strconv.Atoi(strings.TrimPrefix(rest, "-"))
+	if !strings.HasPrefix(rest, "-") || err != nil || counter < 1 {
+		return backup{}, false
+	}
+	return backup{at: at, counter: counter}, true
+}
+
+// remove the oldest rotated files beyond the retained number
+func (f *RotatingFile) prune() error {
+	if f.opts.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups[min(f.opts.MaxBackups, len(backups)):] {
+		if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// gzip the file next to it and remove the source
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,256 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// open a rotating file in a temporary directory, its clock is moved by the returned function
+func openTestRotatingFile(t *testing.T, opts RotateOptions) (*RotatingFile, func(time.Duration)) {
+	now := time.Date(2024, 3, 13, 8, 0, 0, 0, time.UTC)
+	f := &RotatingFile{path: filepath.Join(t.TempDir(), "server.log"), opts: opts, now: func() time.Time { return now }}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, func(d time.Duration) { now = now.Add(d) }
+}
+
+// write the line and fail the test on an error
+func writeLine(t *testing.T, f *RotatingFile, line string) {
+	if _, err := f.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// read the file, a gzip file is decompressed
+func readLog(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if filepath.Ext(path) == ".gz" {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// list the rotated files after the background work is done
+func listBackups(t *testing.T, f *RotatingFile) []string {
+	f.wg.Wait()
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+// test the file is rotated before a line would exceed the size
+func TestRotatingFile_MaxSize(t *testing.T) {
+	f, advance := openTestRotatingFile(t, RotateOptions{MaxSize: 10})
+
+	writeLine(t, f, "aaaa\n")
+	writeLine(t, f, "bbbb\n")
+	advance(time.Second)
+	writeLine(t, f, "cccc\n")
+
+	backups := listBackups(t, f)
+	if assert.Len(t, backups, 1) {
+		assert.Equal(t, filepath.Join(filepath.Dir(f.path), "server-2024-03-13T08-00-01.000.log"), backups[0])
+		assert.Equal(t, "aaaa\nbbbb\n", readLog(t, backups[0]))
+	}
+	assert.Equal(t, "cccc\n", readLog(t, f.path))
+
+	// a line larger than the size is written to an empty file as a whole
+	advance(time.Second)
+	writeLine(t, f, "a line larger than the size\n")
+	assert.Len(t, listBackups(t, f), 2)
+	assert.Equal(t, "a line larger than the size\n", readLog(t, f.path))
+}
+
+// test the file is rotated when it has been opened for the age
+func TestRotatingFile_MaxAge(t *testing.T) {
+	f, advance := openTestRotatingFile(t, RotateOptions{MaxAge: time.Hour})
+
+	writeLine(t, f, "first\n")
+	advance(30 * time.Minute)
+	writeLine(t, f, "second\n")
+	assert.Empty(t, listBackups(t, f))
+
+	advance(30 * time.Minute)
+	writeLine(t, f, "third\n")
+	backups := listBackups(t, f)
+	if assert.Len(t, backups, 1) {
+		assert.Equal(t, "first\nsecond\n", readLog(t, backups[0]))
+	}
+	assert.Equal(t, "third\n", readLog(t, f.path))
+}
+
+// test the rotated files are compressed and only the newest ones are kept
+func TestRotatingFile_Retention(t *testing.T) {
+	f, advance := openTestRotatingFile(t, RotateOptions{MaxBackups: 2, Compress: true})
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		writeLine(t, f, line)
+		advance(time.Minute)
+		if err := f.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups := listBackups(t, f)
+	if assert.Len(t, backups, 2) {
+		assert.Equal(t, ".gz", filepath.Ext(backups[0]))
+		assert.Equal(t, "four\n", readLog(t, backups[0]))
+		assert.Equal(t, "three\n", readLog(t, backups[1]))
+	}
+
+	// the other files in the directory are left alone
+	other := filepath.Join(filepath.Dir(f.path), "server-notes.log")
+	if err := os.WriteFile(other, []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeLine(t, f, "five\n")
+	advance(time.Minute)
+	if err := f.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, listBackups(t, f), 2)
+	assert.FileExists(t, other)
+}
+
+// test the lines are written to a new file after the file is moved away and reopened
+func TestRotatingFile_Reopen(t *testing.T) {
+	f, _ := openTestRotatingFile(t, RotateOptions{})
+
+	writeLine(t, f, "before\n")
+	moved := f.path + ".1"
+	if err := os.Rename(f.path, moved); err != nil {
+		t.Fatal(err)
+	}
+	// the moved file is still written until the file is reopened
+	writeLine(t, f, "moved\n")
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	writeLine(t, f, "after\n")
+
+	assert.Equal(t, "before\nmoved\n", readLog(t, moved))
+	assert.Equal(t, "after\n", readLog(t, f.path))
+}
+
+// test an existing file is appended, and its size counts towards the rotation
+func TestOpenRotatingFile_Append(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "server.log")
+	f, err := OpenRotatingFile(path, RotateOptions{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLine(t, f, "aaaaaaaa\n")
+	assert.NoError(t, f.Close())
+
+	f, err = OpenRotatingFile(path, RotateOptions{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeLine(t, f, "bbbb\n")
+	assert.Len(t, listBackups(t, f), 1)
+	assert.Equal(t, "bbbb\n", readLog(t, path))
+}
+
+// test the files rotated in the same millisecond are all kept and sorted in the order of rotation
+func TestRotatingFile_SameMillisecond(t *testing.T) {
+	f, _ := openTestRotatingFile(t, RotateOptions{MaxBackups: 5})
+
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		writeLine(t, f, line)
+		if err := f.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups := listBackups(t, f)
+	if assert.Len(t, backups, 3) {
+		assert.Equal(t, filepath.Join(filepath.Dir(f.path), "server-2024-03-13T08-00-00.000-2.log"), backups[0])
+		assert.Equal(t, "three\n", readLog(t, backups[0]))
+		assert.Equal(t, "two\n", readLog(t, backups[1]))
+		assert.Equal(t, "one\n", readLog(t, backups[2]))
+	}
+}
+
+// test the stamp in the name of a rotated file is parsed with its counter
+func TestParseBackupStamp(t *testing.T) {
+	at := time.Date(2024, 3, 13, 8, 0, 1, 0, time.UTC)
+	tests := []struct {
+		stamp string
+		want  backup
+		ok    bool
+	}{
+		{"2024-03-13T08-00-01.000", backup{at: at}, true},
+		{"2024-03-13T08-00-01.000-3", backup{at: at, counter: 3}, true},
+		{"2024-03-13T08-00-01.000-0", backup{}, false},
+		{"2024-03-13T08-00-01.000-x", backup{}, false},
+		{"2024-03-13T08-00-01.0003", backup{}, false},
+		{"notes", backup{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseBackupStamp(test.stamp)
+		assert.Equal(t, test.ok, ok, test.stamp)
+		assert.Equal(t, test.want, got, test.stamp)
+	}
+}
+
+// test the age of a file is measured from when it was started, not from when it was opened again after a restart
+func TestRotatingFile_MaxAgeRestart(t *testing.T) {
+	f, advance := openTestRotatingFile(t, RotateOptions{MaxAge: time.Hour})
+
+	// the file was started by the last rotation
+	writeLine(t, f, "first\n")
+	if err := f.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	writeLine(t, f, "second\n")
+	assert.NoError(t, f.Close())
+	advance(40 * time.Minute)
+	assert.NoError(t, f.open())
+	advance(20 * time.Minute)
+	writeLine(t, f, "third\n")
+	assert.Len(t, listBackups(t, f), 2)
+	assert.Equal(t, "third\n", readLog(t, f.path))
+
+	// a file never rotated is measured from its last write
+	path := filepath.Join(t.TempDir(), "server.log")
+	started := time.Date(2024, 3, 13, 8, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, started, started); err != nil {
+		t.Fatal(err)
+	}
+	g := &RotatingFile{path: path, opts: RotateOptions{MaxAge: time.Hour}, now: func() time.Time { return started.Add(time.Hour) }}
+	if err := g.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	writeLine(t, g, "new\n")
+	assert.Len(t, listBackups(t, g), 1)
+	assert.Equal(t, "new\n", readLog(t, path))
+}
@@ -1,27 +1,232 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"dcard/config"
+	"dcard/logging"
+	"dcard/metrics"
 	"dcard/process"
+	"dcard/storage"
+	"dcard/tracing"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	// set a log file to monitor the conditions
-	logFile, err := os.OpenFile("server.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// read the settings from the config file, the environment variables and the flags, the server does not start with an invalid one
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// set a log file to monitor the conditions, every line is a json object with its level, the file is rotated by size and age
+	logFile, err := logging.OpenRotatingFile(cfg.Log.Path, cfg.Log.Rotate())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 	defer logFile.Close()
-	log.SetOutput(logFile)
+	logging.Setup(logFile, cfg.Log.Level, cfg.Log.RedactHeaders)
+	reopenOnHangup(logFile)
+
+	// the debug messages of gin are only printed at the debug level
+	if cfg.Log.Level != "debug" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	if err := run(cfg); err != nil {
+		slog.Error("The server is stopped by an error", "err", err)
+		logFile.Close()
+		os.Exit(1)
+	}
+}
+
+// reopen the log file on SIGHUP, so an external logrotate can move the file away
+func reopenOnHangup(logFile *logging.RotatingFile) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := logFile.Reopen(); err != nil {
+				fmt.Fprintln(os.Stderr, "Fail to reopen the log file:", err)
+				continue
+			}
+			slog.Info("The log file is reopened")
+		}
+	}()
+}
 
-	// set a router
-	router := gin.Default()
+// build the store and serve the api until SIGINT or SIGTERM, the store is closed after the requests in flight are drained
+func run(cfg *config.Config) error {
+	// export the spans of the requests and the mongodb commands, the ones in the batch are flushed when the server stops
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Options())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Fail to flush the spans", "err", err)
+		}
+	}()
+
+	// the limits on creating ads
+	quota := storage.Quota{DailyLimit: cfg.Quota.DailyLimit, ActiveLimit: cfg.Quota.ActiveLimit}
+
+	// connecting to the store and loading the cache give up after the startup timeout, so a hung mongod fails the start
+	startCtx, cancelStart := timeoutContext(cfg.Timeout.Startup)
+	defer cancelStart()
+
+	// set the ad store backend
+	var backend storage.SnapshotSource
+	var mgoClient *storage.MgoClient
+	switch cfg.Server.Store {
+	case "mongo":
+		// a single mongo-client is shared by all handlers
+		mgoClient, err = newMgoClient(startCtx, cfg.MongoDB)
+		if err != nil {
+			return err
+		}
+		defer mgoClient.Close()
+		backend = storage.NewMongoStore(mgoClient, storage.WithQuota(quota))
+	case "memory":
+		backend = storage.NewMemoryStore(storage.WithQuota(quota))
+	}
+
+	// answer the GET hot path from an in-memory snapshot of the ads when the cache is enabled
+	var store storage.AdStore = backend
+	if cfg.Cache.Enabled {
+		var cacheOptions []storage.Option
+		if cfg.Cache.Fallback {
+			cacheOptions = append(cacheOptions, storage.WithStaleFallback())
+		}
+		cache, err := storage.NewCachedStore(startCtx, backend, cfg.Cache.RefreshInterval, cacheOptions...)
+		if err != nil {
+			return err
+		}
+		defer cache.Close()
+		store = cache
+
+		// apply the writes made through the other servers to the cache, only mongodb is shared between the servers
+		switch {
+		case cfg.Cache.Watch && mgoClient != nil:
+			cache.Watch(storage.NewMongoWatcher(mgoClient, cfg.Cache.PollInterval))
+		case cfg.Cache.Watch:
+			slog.Warn("The cache is not watched, only the mongo store can be watched", "store", cfg.Server.Store)
+		}
+	}
 
-	router.POST("/api/v1/ad", process.ProcessPost)
-	router.GET("/api/v1/ad", process.ProcessGet)
+	// inject the store into the handlers, every store operation is bounded by the timeout of its kind
+	handler := process.NewHandler(store, process.WithTimeouts(process.Timeouts{
+		Query: cfg.Timeout.Query,
+		Get:   cfg.Timeout.Get,
+		Write: cfg.Timeout.Write,
+		Usage: cfg.Timeout.Usage,
+		Ready: cfg.Timeout.Ready,
+	}))
 
-	router.Run()
+	// expose the ads active now, counted by the store on every scrape
+	if err := metrics.RegisterActiveAds(func() (int, error) {
+		ctx, cancel := timeoutContext(cfg.Timeout.Usage)
+		defer cancel()
+		usage, err := store.Usage(ctx)
+		return usage.Active, err
+	}); err != nil {
+		return err
+	}
+
+	// set a router, every request is traced, gets a request id for its log lines and is counted and timed by its route and status
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware(), logging.Middleware(), metrics.Middleware())
+
+	router.POST("/api/v1/ad", handler.ProcessPost)
+	router.GET("/api/v1/ad", handler.ProcessGet)
+	router.GET("/api/v1/ad/:id", handler.ProcessGetByID)
+	router.PUT("/api/v1/ad/:id", handler.ProcessPut)
+	router.PATCH("/api/v1/ad/:id", handler.ProcessPatch)
+	router.DELETE("/api/v1/ad/:id", handler.ProcessDelete)
+	router.GET("/api/v1/admin/usage", handler.ProcessUsage)
+	router.GET("/healthz", handler.ProcessHealthz)
+	router.GET("/readyz", handler.ProcessReadyz)
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	// serve https when the certificate and the key are given
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: router}
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "addr", cfg.Server.Addr, "tls", cfg.Server.TLS())
+		if cfg.Server.TLS() {
+			serveErr <- server.ListenAndServeTLS(cfg.Server.TLSCert, cfg.Server.TLSKey)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	// wait until the server fails or is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	// fail the readiness check first and keep serving until the load balancer sees it, then stop accepting the
+	// connections and wait for the requests in flight
+	slog.Info("Shutting down, fail the readiness check", "delay", cfg.Server.DrainDelay.String())
+	handler.Drain()
+	time.Sleep(cfg.Server.DrainDelay)
+	slog.Info("Drain the requests in flight", "timeout", cfg.Server.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("drain the requests in flight: %w", err)
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("The server is stopped")
+	return nil
+}
+
+// establish the mongo-client with the connection info and pool options in the config, and create its indexes
+func newMgoClient(ctx context.Context, mgo config.MongoDB) (*storage.MgoClient, error) {
+	mgoClient, err := storage.NewMgoClient(ctx, mgo.URI, mgo.Database, mgo.Collection, storage.MgoOptions{
+		MaxPoolSize:            mgo.MaxPoolSize,
+		MinPoolSize:            mgo.MinPoolSize,
+		MaxConnIdleTime:        mgo.MaxConnIdleTime,
+		ConnectTimeout:         mgo.ConnectTimeout,
+		ServerSelectionTimeout: mgo.ServerSelectionTimeout,
+		Retry:                  storage.RetryOptions{Attempts: mgo.RetryAttempts, BaseDelay: mgo.RetryBaseDelay, MaxDelay: mgo.RetryMaxDelay},
+		Breaker:                storage.BreakerOptions{Threshold: mgo.BreakerThreshold, Cooldown: mgo.BreakerCooldown},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure the query is backed by indexes
+	if err := mgoClient.EnsureIndexes(ctx); err != nil {
+		mgoClient.Close()
+		return nil, err
+	}
+	return mgoClient, nil
+}
+
+// derive a context ending after the timeout, a zero timeout never ends it
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
 }
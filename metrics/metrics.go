@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// the registry exposed on /metrics, it has the go runtime and the process metrics as well
+var Registry = prometheus.NewRegistry()
+
+// the buckets of the latencies from 0.5ms to about 4s, the cache answers well below the default 5ms bucket
+var latencyBuckets = prometheus.ExponentialBuckets(0.0005, 2, 14)
+
+var factory = promauto.With(Registry)
+
+var (
+	// the requests served per route and status, the route is the pattern like /api/v1/ad/:id
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ads_http_requests_total",
+		Help: "The http requests served, by method, route and status.",
+	}, []string{"method", "route", "status"})
+	HTTPDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ads_http_request_duration_seconds",
+		Help:    "The latency of the http requests, by method, route and status.",
+		Buckets: latencyBuckets,
+	}, []string{"method", "route", "status"})
+
+	// the commands sent to mongodb by the mongo-client
+	MongoDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ads_mongo_command_duration_seconds",
+		Help:    "The latency of the mongodb commands, by command.",
+		Buckets: latencyBuckets,
+	}, []string{"command"})
+	MongoErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ads_mongo_command_errors_total",
+		Help: "The mongodb commands which failed, by command.",
+	}, []string{"command"})
+
+	// the operations on mongodb retried after a transient error, and the circuit breaker failing them fast while it is down
+	MongoRetries = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ads_mongo_retries_total",
+		Help: "The mongodb operations retried after a transient error.",
+	})
+	MongoCircuitState = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "ads_mongo_circuit_state",
+		Help: "The state of the circuit breaker around mongodb: 0 closed, 1 half-open or 2 open.",
+	})
+
+	// the queries answered by the cache, a hit is answered by the loaded snapshot, a miss reloads it first and a stale
+	// one falls back to the last snapshot when it can not be reloaded
+	CacheLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ads_cache_lookups_total",
+		Help: "The queries answered by the cache, by result: hit, miss or stale.",
+	}, []string{"result"})
+
+	// the ads returned by GET /api/v1/ad, by the country and the platform of the query
+	AdsServed = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ads_served_total",
+		Help: "The ads returned by the queries, by the country and the platform asked for.",
+	}, []string{"country", "platform"})
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// define the gauge of the ads active now, it is counted by the store on every scrape
+type activeAds struct {
+	desc  *prometheus.Desc
+	count func() (int, error)
+}
+
+func (a *activeAds) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.desc
+}
+
+// the gauge is left out of the scrape when the store can not count the ads
+func (a *activeAds) Collect(ch chan<- prometheus.Metric) {
+	count, err := a.count()
+	if err != nil {
+		slog.Warn("Fail to count the active ads", "err", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, float64(count))
+}
+
+// expose the number of the active ads counted by the given function
+func RegisterActiveAds(count func() (int, error)) error {
+	return Registry.Register(&activeAds{
+		desc:  prometheus.NewDesc("ads_active", "The ads active now.", nil, nil),
+		count: count,
+	})
+}
+
+// record the count and the latency of every request, the requests matching no route share one label
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		HTTPRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		HTTPDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// serve the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
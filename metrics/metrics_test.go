@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// serve a request to the router and return the recorder
+func serve(router *gin.Engine, method, url string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// test the middleware counts the requests by their route pattern and status
+func TestMiddleware(t *testing.T) {
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/test-metrics/:id", func(c *gin.Context) {
+		if c.Param("id") == "missing" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	ok := HTTPRequests.WithLabelValues("GET", "/test-metrics/:id", "200")
+	notFound := HTTPRequests.WithLabelValues("GET", "/test-metrics/:id", "404")
+	unmatched := HTTPRequests.WithLabelValues("GET", "unmatched", "404")
+	before := []float64{testutil.ToFloat64(ok), testutil.ToFloat64(notFound), testutil.ToFloat64(unmatched)}
+
+	serve(router, "GET", "/test-metrics/1")
+	serve(router, "GET", "/test-metrics/2")
+	serve(router, "GET", "/test-metrics/missing")
+	serve(router, "GET", "/not-exist/abc")
+
+	assert.Equal(t, before[0]+2, testutil.ToFloat64(ok))
+	assert.Equal(t, before[1]+1, testutil.ToFloat64(notFound))
+	assert.Equal(t, before[2]+1, testutil.ToFloat64(unmatched))
+
+	// the latency is observed with the same labels
+	histogram := HTTPDuration.WithLabelValues("GET", "/test-metrics/:id", "200").(prometheus.Histogram)
+	assert.Equal(t, 1, testutil.CollectAndCount(histogram))
+}
+
+// test the active ads are counted on every scrape, and left out when they can not be counted
+func TestRegisterActiveAds(t *testing.T) {
+	active, err := 3, error(nil)
+	collector := &activeAds{
+		desc:  prometheus.NewDesc("ads_active", "The ads active now.", nil, nil),
+		count: func() (int, error) { return active, err },
+	}
+	assert.Equal(t, float64(3), testutil.ToFloat64(collector))
+
+	active = 5
+	assert.Equal(t, float64(5), testutil.ToFloat64(collector))
+
+	err = errors.New("connection refused")
+	assert.Equal(t, 0, testutil.CollectAndCount(collector))
+
+	// it is exposed on the registry only once
+	assert.NoError(t, RegisterActiveAds(func() (int, error) { return 7, nil }))
+	assert.Error(t, RegisterActiveAds(func() (int, error) { return 7, nil }))
+}
+
+// test the handler exposes every metric in the prometheus text format
+func TestHandler(t *testing.T) {
+	CacheLookups.WithLabelValues("hit").Add(0)
+	AdsServed.WithLabelValues("TW", "ios").Add(0)
+	MongoDuration.WithLabelValues("find").Observe(0.001)
+	MongoErrors.WithLabelValues("find").Add(0)
+	HTTPRequests.WithLabelValues("GET", "/api/v1/ad", "200").Add(0)
+	HTTPDuration.WithLabelValues("GET", "/api/v1/ad", "200").Observe(0.001)
+
+	router := gin.New()
+	router.GET("/metrics", gin.WrapH(Handler()))
+	recorder := serve(router, "GET", "/metrics")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	body := recorder.Body.String()
+	for _, name := range []string{
+		"ads_http_requests_total", "ads_http_request_duration_seconds_bucket", "ads_mongo_command_duration_seconds_bucket",
+		"ads_mongo_command_errors_total", "ads_mongo_retries_total", "ads_mongo_circuit_state", "ads_cache_lookups_total",
+		"ads_served_total", "go_goroutines",
+	} {
+		assert.True(t, strings.Contains(body, name), "missing %s", name)
+	}
+}
@@ -0,0 +1,24 @@
+package process
+
+import (
+	"net/http"
+
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) ProcessDelete(c *gin.Context) {
+	id := c.Param("id")
+
+	// call store function to delete the ad
+	ctx, cancel := operationContext(c, h.timeouts.Write)
+	defer cancel()
+	if err := storage.DeleteData(ctx, h.store, id); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// return a success feedback
+	c.JSON(http.StatusOK, gin.H{"id": id, "message": "DELETE successfully"})
+}
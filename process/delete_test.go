@@ -0,0 +1,31 @@
+package process_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"dcard/process"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// test processdelete pulls the ad
+func TestProcessDelete(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.DELETE("/test-ad/:id", process.NewHandler(store).ProcessDelete)
+
+	// delete the ad
+	recorder := serveJSON(router, "DELETE", "/test-ad/"+id, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"id":"`+id+`","message":"DELETE successfully"}`, recorder.Body.String())
+	_, err := store.Get(context.Background(), id)
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	// delete it again
+	recorder = serveJSON(router, "DELETE", "/test-ad/"+id, "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
@@ -1,13 +1,15 @@
 package process
 
 import (
-	"errors"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
 
+	"dcard/apperr"
+	"dcard/logging"
+	"dcard/metrics"
 	"dcard/storage"
+	"dcard/tracing"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,55 +19,106 @@ type item struct {
 	Endat time.Time `json:"endAt"`
 }
 
-func ProcessGet(c *gin.Context) {
-	var query storage.QueryRequest
+func (h *Handler) ProcessGet(c *gin.Context) {
+	query, err := parseQuery(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// call function to query data, within the timeout of a query
+	ctx, cancel := operationContext(c, h.timeouts.Query)
+	defer cancel()
+	results, err := storage.QueryData(ctx, h.store, query)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// count the ads served to the audience, the unknown values share one label so the series stay bounded
+	metrics.AdsServed.WithLabelValues(servedLabel(query.Country, countryCodes), servedLabel(query.Platform, platforms)).Add(float64(len(results)))
+
+	// get title and endat, then store as an array, every item is only logged at the debug level
+	logger := logging.FromContext(c.Request.Context())
+	items := make([]item, len(results))
+	for i, result := range results {
+		items[i].Title = result.Title
+		items[i].Endat = result.EndAt
+		logger.Debug("GET item", "title", items[i].Title, "endAt", items[i].Endat)
+	}
+
+	// a full page may be followed by another one, so return the cursor of its last item
+	response := gin.H{"items": items}
+	if len(results) > 0 && len(results) == query.Limit {
+		response["next_cursor"] = storage.CursorOf(results[len(results)-1]).Encode()
+	}
+
+	// return the query results with json format
+	c.JSON(http.StatusOK, response)
+}
+
+// parse the query requirement, in a span of its own so the parsing is told apart from the store
+func parseQuery(c *gin.Context) (query storage.QueryRequest, err error) {
+	_, span := tracing.Start(c.Request.Context(), "parse query")
+	defer func() { tracing.End(span, err) }()
 
-	// record the clientIP
+	// record the clientIP and headers
 	query.ClientIP = c.ClientIP()
+	query.Headers = requestHeaders(c)
 
-	// record the clientIP
-	query.Headers = make(map[string][]string)
-	for key, vals := range c.Request.Header {
-		query.Headers[key] = make([]string, 0)
-		query.Headers[key] = append(query.Headers[key], vals...)
+	// parse the page, a cursor continues right after the previous page, otherwise the offset is used
+	if token := c.Query("cursor"); token != "" {
+		after, err := storage.DecodeCursor(token)
+		if err != nil {
+			return query, err
+		}
+		query.After = &after
+	} else {
+		query.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "5"))
+		if query.Offset < 1 || query.Offset > 100 {
+			return query, apperr.NewValidation("offset", "out_of_range", "offset should be in this interval: [1, 100]")
+		}
+		query.Offset -= 1
 	}
 
 	// parse the query requirement
-	query.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "5"))
-	if query.Offset < 1 || query.Offset > 100 {
-		err := errors.New("offset should be in this interval: [1, 100]")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	query.Offset -= 1
 	query.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "5"))
 	if query.Limit < 1 || query.Limit > 100 {
-		err := errors.New("limit should be in this interval: [1, 100]")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return query, apperr.NewValidation("limit", "out_of_range", "limit should be in this interval: [1, 100]")
 	}
-	query.Age, _ = strconv.Atoi(c.DefaultQuery("age", "0"))
+	age, err := strconv.Atoi(c.DefaultQuery("age", "0"))
+	if err != nil {
+		return query, apperr.NewValidation("age", "not_integer", "age should be an integer")
+	}
+	query.Age = age
 	query.Gender = c.DefaultQuery("gender", "")
 	query.Country = c.DefaultQuery("country", "")
 	query.Platform = c.DefaultQuery("platform", "")
-	
-	// call function to query data
-	results, err := storage.QueryData(query)
-	if err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	return query, nil
+}
+
+// the label of a query value in the metrics, "any" when it is not given and "other" when it is not a known value
+func servedLabel(value string, known map[string]bool) string {
+	switch {
+	case value == "":
+		return "any"
+	case known[value]:
+		return value
+	default:
+		return "other"
 	}
+}
 
-	// get title and endat, then store as an array
-	items := make([]item, len(results))
-	for i, result := range results {
-		items[i].Title = result.Title
-		items[i].Endat = result.EndAt
-		log.Println(items[i])
+func (h *Handler) ProcessGetByID(c *gin.Context) {
+	// call function to get the ad
+	ctx, cancel := operationContext(c, h.timeouts.Get)
+	defer cancel()
+	ad, err := storage.GetData(ctx, h.store, c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
-	// return the query results with json format
-	c.JSON(http.StatusOK, gin.H{"items": items})
+	// return the whole ad with json format
+	c.JSON(http.StatusOK, ad)
 }
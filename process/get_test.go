@@ -1,18 +1,27 @@
 package process_test
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"dcard/metrics"
+	"dcard/process"
 	"dcard/storage"
+	"dcard/tracing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type item struct {
@@ -20,68 +29,13 @@ type item struct {
 	Endat time.Time `json:"endAt"`
 }
 
-func ProcessGet(c *gin.Context) {
-	var query storage.QueryRequest
-
-	// record the clientIP
-	query.ClientIP = c.ClientIP()
-
-	// record the clientIP
-	query.Headers = make(map[string][]string)
-	for key, vals := range c.Request.Header {
-		query.Headers[key] = make([]string, 0)
-		query.Headers[key] = append(query.Headers[key], vals...)
-	}
-
-	// parse the query requirement
-	query.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "5"))
-	if query.Offset < 1 || query.Offset > 100 {
-		err := errors.New("offset should be in this interval: [1, 100]")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	query.Offset -= 1
-	query.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "5"))
-	if query.Limit < 1 || query.Limit > 100 {
-		err := errors.New("limit should be in this interval: [1, 100]")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	query.Age, _ = strconv.Atoi(c.DefaultQuery("age", "0"))
-	query.Gender = c.DefaultQuery("gender", "")
-	query.Country = c.DefaultQuery("country", "")
-	query.Platform = c.DefaultQuery("platform", "")
-
-	// call function to query data
-	// results, err := storage.QueryData(query)
-	// if err != nil {
-	// 	log.Println(err)
-	// 	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-	// }
-
-	// get title and endat, then store as an array
-	// items := make([]item, len(results))
-	// for i, result := range results {
-	// 	items[i].Title = result.Title
-	// 	items[i].Endat = result.EndAt
-	// 	log.Println(items[i])
-	// }
-
-	test_items := make([]item, 0)
-
-	// return the query results with json format
-	c.JSON(http.StatusOK, gin.H{"items": test_items})
-}
-
 // test processget with offest < 1 || offset > 100
 func TestProcessGet_Offset_OutRange(t *testing.T) {
 	// Create a new Gin router
 	router := gin.Default()
 
 	// Set up the endpoint handler
-	router.GET("/test-offset", ProcessGet)
+	router.GET("/test-offset", newTestHandler().ProcessGet)
 
 	// Perform GET requests with out of offset == 0 || 101
 	req0, err := http.NewRequest("GET", "/test-offset?offset=0", nil)
@@ -103,30 +57,33 @@ func TestProcessGet_Offset_OutRange(t *testing.T) {
 
 
 	// Check the response status code
-	if recorder0.Code != http.StatusInternalServerError {
-		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, recorder0.Code)
+	if recorder0.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, recorder0.Code)
 	}
-	if recorder101.Code != http.StatusInternalServerError {
-		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, recorder101.Code)
+	if recorder101.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, recorder101.Code)
 	}
 
 	// Decode the response body
-	var responseBody0 map[string]string
+	var responseBody0 errorBody
 	if err := json.Unmarshal(recorder0.Body.Bytes(), &responseBody0); err != nil {
 		t.Fatal(err)
 	}
-	var responseBody101 map[string]string
-	if err := json.Unmarshal(recorder0.Body.Bytes(), &responseBody101); err != nil {
+	var responseBody101 errorBody
+	if err := json.Unmarshal(recorder101.Body.Bytes(), &responseBody101); err != nil {
 		t.Fatal(err)
 	}
 
 	// Check if the error message is as expected
 	expectedErrorMessage := "offset should be in this interval: [1, 100]"
-	if responseBody0["error"] != expectedErrorMessage {
-		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody0["error"])
+	if responseBody0.Error.Field != "offset" || responseBody101.Error.Field != "offset" {
+		t.Errorf("Expected error field 'offset', got '%s' and '%s'", responseBody0.Error.Field, responseBody101.Error.Field)
+	}
+	if responseBody0.Error.Message != expectedErrorMessage {
+		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody0.Error.Message)
 	}
-	if responseBody101["error"] != expectedErrorMessage {
-		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody101["error"])
+	if responseBody101.Error.Message != expectedErrorMessage {
+		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody101.Error.Message)
 	}
 }
 
@@ -136,7 +93,7 @@ func TestProcessGet_Offset_InRange(t *testing.T) {
     router := gin.Default()
 
     // Set up the endpoint handler
-    router.GET("/test-offset", ProcessGet)
+    router.GET("/test-offset", newTestHandler().ProcessGet)
 
     // Perform a GET request with valid offset
     req, err := http.NewRequest("GET", "/test-offset?offset=55", nil)
@@ -173,7 +130,7 @@ func TestProcessGet_Limit_OutRange(t *testing.T) {
 	router := gin.Default()
 
 	// Set up the endpoint handler
-	router.GET("/test-limit", ProcessGet)
+	router.GET("/test-limit", newTestHandler().ProcessGet)
 
 	// Perform GET requests with out of limit == 0 || 101
 	req0, err := http.NewRequest("GET", "/test-limit?limit=0", nil)
@@ -195,30 +152,33 @@ func TestProcessGet_Limit_OutRange(t *testing.T) {
 
 
 	// Check the response status code
-	if recorder0.Code != http.StatusInternalServerError {
-		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, recorder0.Code)
+	if recorder0.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, recorder0.Code)
 	}
-	if recorder101.Code != http.StatusInternalServerError {
-		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, recorder101.Code)
+	if recorder101.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, recorder101.Code)
 	}
 
 	// Decode the response body
-	var responseBody0 map[string]string
+	var responseBody0 errorBody
 	if err := json.Unmarshal(recorder0.Body.Bytes(), &responseBody0); err != nil {
 		t.Fatal(err)
 	}
-	var responseBody101 map[string]string
-	if err := json.Unmarshal(recorder0.Body.Bytes(), &responseBody101); err != nil {
+	var responseBody101 errorBody
+	if err := json.Unmarshal(recorder101.Body.Bytes(), &responseBody101); err != nil {
 		t.Fatal(err)
 	}
 
 	// Check if the error message is as expected
 	expectedErrorMessage := "limit should be in this interval: [1, 100]"
-	if responseBody0["error"] != expectedErrorMessage {
-		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody0["error"])
+	if responseBody0.Error.Field != "limit" || responseBody101.Error.Field != "limit" {
+		t.Errorf("Expected error field 'limit', got '%s' and '%s'", responseBody0.Error.Field, responseBody101.Error.Field)
 	}
-	if responseBody101["error"] != expectedErrorMessage {
-		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody101["error"])
+	if responseBody0.Error.Message != expectedErrorMessage {
+		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody0.Error.Message)
+	}
+	if responseBody101.Error.Message != expectedErrorMessage {
+		t.Errorf("Expected error message '%s', got '%s'", expectedErrorMessage, responseBody101.Error.Message)
 	}
 }
 
@@ -228,7 +188,7 @@ func TestProcessGet_Limit_InRange(t *testing.T) {
     router := gin.Default()
 
     // Set up the endpoint handler
-    router.GET("/test-limit", ProcessGet)
+    router.GET("/test-limit", newTestHandler().ProcessGet)
 
     // Perform a GET request with valid offset
     req, err := http.NewRequest("GET", "/test-limit?limit=55", nil)
@@ -258,3 +218,166 @@ func TestProcessGet_Limit_InRange(t *testing.T) {
         t.Errorf("Expected response to contain 'items' key, got %v", responseBody)
     }
 }
+
+// test processget pages through the ads with next_cursor
+func TestProcessGet_Cursor(t *testing.T) {
+	// insert test ads into an in-memory store
+	store := storage.NewMemoryStore()
+	for i := 0; i < 5; i++ {
+		_, err := store.Insert(context.Background(), storage.File{
+			Title:   "test AD" + strconv.Itoa(i),
+			StartAt: time.Now(),
+			EndAt:   time.Now().Add(time.Duration(i+1) * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Create a new Gin router
+	router := gin.Default()
+	router.GET("/test-cursor", process.NewHandler(store).ProcessGet)
+
+	// Follow next_cursor until the last page
+	titles := make([]string, 0)
+	url := "/test-cursor?offset=1&limit=2"
+	for page := 0; page < 5; page++ {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, recorder.Code)
+		}
+
+		var responseBody struct {
+			Items      []item `json:"items"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+			t.Fatal(err)
+		}
+		for _, it := range responseBody.Items {
+			titles = append(titles, it.Title)
+		}
+		if responseBody.NextCursor == "" {
+			break
+		}
+		url = "/test-cursor?limit=2&cursor=" + responseBody.NextCursor
+	}
+
+	// Check every ad is returned once in order
+	expected := []string{"test AD0", "test AD1", "test AD2", "test AD3", "test AD4"}
+	if strings.Join(titles, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected titles %v, got %v", expected, titles)
+	}
+}
+
+// test processget with an invalid cursor
+func TestProcessGet_Cursor_Invalid(t *testing.T) {
+	// Create a new Gin router
+	router := gin.Default()
+	router.GET("/test-cursor", newTestHandler().ProcessGet)
+
+	// Perform a GET request with an invalid cursor
+	req, err := http.NewRequest("GET", "/test-cursor?cursor=invalid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	// Check the response status code
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+// test processgetbyid returns the whole ad
+func TestProcessGetByID(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.GET("/test-ad/:id", process.NewHandler(store).ProcessGetByID)
+
+	// get the existing ad
+	recorder := serveJSON(router, "GET", "/test-ad/"+id, "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, recorder.Code)
+	}
+	var ad storage.File
+	if err := json.Unmarshal(recorder.Body.Bytes(), &ad); err != nil {
+		t.Fatal(err)
+	}
+	if ad.ID != id || ad.Title != "test AD" || ad.Conditions[0].Country[0] != "TW" {
+		t.Errorf("Expected the test ad, got %v", ad)
+	}
+
+	// get an ad which does not exist
+	recorder = serveJSON(router, "GET", "/test-ad/not-exist", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+// test processget counts the ads served by the country and the platform of the query
+func TestProcessGet_AdsServed(t *testing.T) {
+	store := storage.NewMemoryStore()
+	for i := 0; i < 3; i++ {
+		_, err := store.Insert(context.Background(), storage.File{Title: "test AD", StartAt: time.Now().Add(-time.Hour), EndAt: time.Now().Add(time.Hour)})
+		assert.NoError(t, err)
+	}
+	router := gin.Default()
+	router.GET("/test-served", process.NewHandler(store).ProcessGet)
+
+	tests := []struct {
+		query    string
+		country  string
+		platform string
+		served   float64
+	}{
+		{"offset=1&limit=2&country=TW&platform=ios", "TW", "ios", 2},
+		{"offset=2&limit=5", "any", "any", 2},
+		{"offset=1&limit=5&country=XX&platform=tv", "other", "other", 3},
+	}
+	for _, tc := range tests {
+		counter := metrics.AdsServed.WithLabelValues(tc.country, tc.platform)
+		before := testutil.ToFloat64(counter)
+		recorder := serveJSON(router, "GET", "/test-served?"+tc.query, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, before+tc.served, testutil.ToFloat64(counter), tc.query)
+	}
+}
+
+// test the query is parsed and answered under the span of the request, and an invalid query fails its parse span
+func TestProcessGet_Trace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	router := gin.New()
+	router.Use(tracing.Middleware())
+	router.GET("/test-trace", process.NewHandler(storage.NewMemoryStore()).ProcessGet)
+
+	assert.Equal(t, http.StatusOK, serveJSON(router, "GET", "/test-trace?offset=1&limit=5", "").Code)
+	spans := recorder.Ended()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name()
+	}
+	assert.Equal(t, []string{"parse query", "sort ads", "QueryData", "GET /test-trace"}, names)
+	server := spans[len(spans)-1].SpanContext().SpanID()
+	assert.Equal(t, server, spans[0].Parent().SpanID())
+	assert.Equal(t, server, spans[2].Parent().SpanID())
+	assert.Equal(t, spans[2].SpanContext().SpanID(), spans[1].Parent().SpanID())
+
+	assert.Equal(t, http.StatusBadRequest, serveJSON(router, "GET", "/test-trace?limit=0", "").Code)
+	spans = recorder.Ended()
+	if assert.Len(t, spans, 6) {
+		assert.Equal(t, "parse query", spans[4].Name())
+		assert.Equal(t, codes.Error, spans[4].Status().Code)
+		assert.Equal(t, codes.Unset, spans[5].Status().Code)
+	}
+}
@@ -0,0 +1,58 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"dcard/apperr"
+	"dcard/logging"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// define the handler struct which serves the ad api with the given store
+type Handler struct {
+	store    storage.AdStore
+	timeouts Timeouts
+
+	// set when the server is shutting down, so it is taken out of the rotation while the requests drain
+	draining atomic.Bool
+}
+
+// set the optional settings of a handler
+type Option func(*Handler)
+
+// establish a new handler backed by the ad store
+func NewHandler(store storage.AdStore, opts ...Option) *Handler {
+	h := &Handler{store: store, timeouts: DefaultTimeouts}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// copy the headers of the request to record them
+func requestHeaders(c *gin.Context) map[string][]string {
+	headers := make(map[string][]string)
+	for key, vals := range c.Request.Header {
+		headers[key] = make([]string, 0)
+		headers[key] = append(headers[key], vals...)
+	}
+	return headers
+}
+
+// write the error to the client with the http status of its kind, only the server errors are logged as errors,
+// a request canceled by its client is not one of them
+func respondError(c *gin.Context, err error) {
+	e := apperr.From(err)
+	level := slog.LevelInfo
+	if e.Status() >= http.StatusInternalServerError && !errors.Is(err, context.Canceled) {
+		level = slog.LevelError
+	}
+	logging.FromContext(c.Request.Context()).Log(c.Request.Context(), level, "Request failed", "status", e.Status(), "code", e.Code, "err", err)
+	c.AbortWithStatusJSON(e.Status(), gin.H{"error": e})
+}
@@ -0,0 +1,166 @@
+package process_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dcard/apperr"
+	"dcard/process"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// define the json body of an error response
+type errorBody struct {
+	Error struct {
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+		Field      string `json:"field"`
+		Violations []struct {
+			Field string `json:"field"`
+			Code  string `json:"code"`
+		} `json:"violations"`
+	} `json:"error"`
+}
+
+// define a fake ad store so the handlers can be tested without mongodb, err is returned by every call when set
+type fakeStore struct {
+	ads []storage.File
+	err error
+}
+
+func (s *fakeStore) Insert(_ context.Context, ad storage.File) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	s.ads = append(s.ads, ad)
+	return "fake-id", nil
+}
+
+func (s *fakeStore) Query(_ context.Context, query storage.QueryRequest) ([]storage.File, error) {
+	if s.err != nil {
+		return []storage.File{}, s.err
+	}
+	return []storage.File{}, nil
+}
+
+func (s *fakeStore) Get(_ context.Context, id string) (storage.File, error) {
+	return storage.File{}, storage.ErrNotFound
+}
+
+func (s *fakeStore) Update(_ context.Context, id string, ad storage.File) error {
+	return storage.ErrNotFound
+}
+
+func (s *fakeStore) Patch(_ context.Context, id string, patch storage.AdPatch) (storage.File, error) {
+	return storage.File{}, storage.ErrNotFound
+}
+
+func (s *fakeStore) Delete(_ context.Context, id string) error {
+	return storage.ErrNotFound
+}
+
+func (s *fakeStore) Usage(_ context.Context) (storage.Usage, error) {
+	if s.err != nil {
+		return storage.Usage{}, s.err
+	}
+	return storage.Usage{Created: len(s.ads)}, nil
+}
+
+func (s *fakeStore) Ping(_ context.Context) error {
+	return s.err
+}
+
+// establish a handler backed by an empty fake store
+func newTestHandler() *process.Handler {
+	return process.NewHandler(&fakeStore{})
+}
+
+// test newhandler uses the injected store
+func TestNewHandler(t *testing.T) {
+	store := &fakeStore{}
+	handler := process.NewHandler(store)
+	assert.NotNil(t, handler)
+
+	// post an ad through the handler
+	router := gin.Default()
+	router.POST("/test-inject", handler.ProcessPost)
+	requestBody := string("{\"title\": \"test AD\", \"startAt\": \"2024-01-21T16:00:00.000Z\", \"endAt\": \"2024-06-21T16:00:00.000Z\"}")
+	req, err := http.NewRequest("POST", "/test-inject", bytes.NewBuffer([]byte(requestBody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	// the injected store should receive the inserted ad
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 1, len(store.ads))
+	assert.Equal(t, "test AD", store.ads[0].Title)
+}
+
+// insert a test ad into a new in-memory store and return its id
+func newTestStoreWithAd(t *testing.T) (*storage.MemoryStore, string) {
+	store := storage.NewMemoryStore()
+	id, err := store.Insert(context.Background(), storage.File{
+		Title:      "test AD",
+		StartAt:    time.Date(2024, 1, 21, 16, 0, 0, 0, time.UTC),
+		EndAt:      time.Date(2024, 6, 21, 16, 0, 0, 0, time.UTC),
+		Conditions: []storage.Condition{{Country: []string{"TW"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, id
+}
+
+// serve a request with a json body to the router and return the recorder
+func serveJSON(router *gin.Engine, method, url, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// test the errors from the store are mapped to their http status
+func TestRespondError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{apperr.Wrap(apperr.Unavailable, "store_unavailable", "the ad store is unavailable", errors.New("connection refused")), http.StatusServiceUnavailable, "store_unavailable"},
+		{apperr.New(apperr.Conflict, "ad_conflict", "the ad conflicts with an existing one"), http.StatusConflict, "ad_conflict"},
+		{errors.New("something is broken"), http.StatusInternalServerError, "internal"},
+	}
+	for _, tc := range tests {
+		router := gin.Default()
+		handler := process.NewHandler(&fakeStore{err: tc.err})
+		router.POST("/test-error", handler.ProcessPost)
+		router.GET("/test-error", handler.ProcessGet)
+
+		// a failed POST only writes the error response
+		requestBody := string("{\"title\": \"test AD\", \"startAt\": \"2024-01-21T16:00:00.000Z\", \"endAt\": \"2024-06-21T16:00:00.000Z\"}")
+		for _, recorder := range []*httptest.ResponseRecorder{
+			serveJSON(router, "POST", "/test-error", requestBody),
+			serveJSON(router, "GET", "/test-error?offset=1", ""),
+		} {
+			assert.Equal(t, tc.status, recorder.Code)
+			var responseBody errorBody
+			if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+				t.Fatalf("Expected a single json error body, got %s", recorder.Body.String())
+			}
+			assert.Equal(t, tc.code, responseBody.Error.Code)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package process
+
+import (
+	"net/http"
+
+	"dcard/apperr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the error returned by the readiness check once the server is shutting down
+var errShuttingDown = apperr.New(apperr.Unavailable, "shutting_down", "the server is shutting down")
+
+// answer the liveness check, the process is alive as long as it can answer
+func (h *Handler) ProcessHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// answer the readiness check, the server is ready when the store is reachable and the cache is loaded
+func (h *Handler) ProcessReadyz(c *gin.Context) {
+	if h.draining.Load() {
+		respondError(c, errShuttingDown)
+		return
+	}
+	// a cached store may reload its snapshot on ping, so the check is bounded like the other store operations
+	ctx, cancel := operationContext(c, h.timeouts.Ready)
+	defer cancel()
+	if err := h.store.Ping(ctx); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// fail the readiness check from now on, the requests in flight are still served
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
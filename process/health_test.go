@@ -0,0 +1,95 @@
+package process_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"dcard/apperr"
+	"dcard/process"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// register the health checks of the handler on a router
+func newHealthRouter(handler *process.Handler) *gin.Engine {
+	router := gin.Default()
+	router.GET("/healthz", handler.ProcessHealthz)
+	router.GET("/readyz", handler.ProcessReadyz)
+	return router
+}
+
+// test processhealthz answers even when the store is unreachable
+func TestProcessHealthz(t *testing.T) {
+	store := &fakeStore{err: apperr.New(apperr.Unavailable, "store_unavailable", "the ad store is unavailable")}
+	router := newHealthRouter(process.NewHandler(store))
+
+	recorder := serveJSON(router, "GET", "/healthz", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, recorder.Body.String())
+}
+
+// test processreadyz follows the store and fails once the handler drains
+func TestProcessReadyz(t *testing.T) {
+	store := &fakeStore{}
+	handler := process.NewHandler(store)
+	router := newHealthRouter(handler)
+
+	recorder := serveJSON(router, "GET", "/readyz", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status": "ready"}`, recorder.Body.String())
+
+	// the store is unreachable
+	store.err = apperr.New(apperr.Unavailable, "store_unavailable", "the ad store is unavailable")
+	recorder = serveJSON(router, "GET", "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	var responseBody errorBody
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "store_unavailable", responseBody.Error.Code)
+
+	// the server is shutting down
+	store.err = nil
+	handler.Drain()
+	recorder = serveJSON(router, "GET", "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "shutting_down", responseBody.Error.Code)
+
+	// the ads are still served while the requests drain
+	store.ads = nil
+	router.POST("/api/v1/ad", handler.ProcessPost)
+	recorder = serveJSON(router, "POST", "/api/v1/ad", `{"title": "test AD", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+// test the readiness check does not wait for a hanging store longer than its timeout
+func TestProcessReadyz_Timeout(t *testing.T) {
+	router := newHealthRouter(process.NewHandler(&hangingStore{}, process.WithTimeouts(process.Timeouts{Ready: 20 * time.Millisecond})))
+
+	start := time.Now()
+	recorder := serveJSON(router, "GET", "/readyz", "")
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Equal(t, "timeout", errorCode(t, recorder))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// test the readiness of a cached store follows its backend
+func TestProcessReadyz_Cached(t *testing.T) {
+	cache, err := storage.NewCachedStore(context.Background(), storage.NewMemoryStore(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	router := newHealthRouter(process.NewHandler(cache))
+
+	recorder := serveJSON(router, "GET", "/readyz", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
@@ -0,0 +1,50 @@
+package process
+
+import (
+	"net/http"
+
+	"dcard/apperr"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) ProcessPatch(c *gin.Context) {
+	var patch storage.AdPatch
+	id := c.Param("id")
+
+	// parse the changed fields into json struct
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		respondError(c, apperr.Wrap(apperr.Validation, "invalid_body", "request body is not a valid ad", err))
+		return
+	}
+
+	// the patched ad should still have the required fields, the read and the write share the timeout of a write
+	ctx, cancel := operationContext(c, h.timeouts.Write)
+	defer cancel()
+	current, err := storage.GetData(ctx, h.store, id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	patched := patch.Apply(current)
+	if err := checkAd(&patched); err != nil {
+		respondError(c, err)
+		return
+	}
+	if patch.Conditions != nil {
+		patch.Conditions = &patched.Conditions
+	}
+	// another request may change the ad after it is read, so the patch is only written on the ad it was checked against
+	patch.Base = &current
+
+	// call store function to change the fields
+	ad, err := storage.PatchData(ctx, h.store, id, patch)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// return the changed ad
+	c.JSON(http.StatusOK, ad)
+}
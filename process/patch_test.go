@@ -0,0 +1,128 @@
+package process_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"dcard/process"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// test processpatch only changes the given fields
+func TestProcessPatch(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PATCH("/test-ad/:id", process.NewHandler(store).ProcessPatch)
+
+	// fix a typo in the title
+	recorder := serveJSON(router, "PATCH", "/test-ad/"+id, "{\"title\": \"test AD fixed\"}")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var responseBody storage.File
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "test AD fixed", responseBody.Title)
+
+	// the other fields are kept
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD fixed", ad.Title)
+	assert.Equal(t, []string{"TW"}, ad.Conditions[0].Country)
+}
+
+// test processpatch sets the schedule of the ad and checks it
+func TestProcessPatch_Schedule(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PATCH("/test-ad/:id", process.NewHandler(store).ProcessPatch)
+
+	recorder := serveJSON(router, "PATCH", "/test-ad/"+id, `{"schedule": {"timeZone": "Asia/Taipei", "hours": [{"start": 18, "end": 24}]}}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	if assert.NotNil(t, ad.Schedule) {
+		assert.Equal(t, "Asia/Taipei", ad.Schedule.TimeZone)
+		assert.Equal(t, []storage.HourRange{{Start: 18, End: 24}}, ad.Schedule.Hours)
+	}
+
+	// an invalid schedule is rejected and the stored one is kept
+	recorder = serveJSON(router, "PATCH", "/test-ad/"+id, `{"schedule": {"timeZone": "Taipei"}}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	ad, err = store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "Asia/Taipei", ad.Schedule.TimeZone)
+
+	// a patch without the schedule keeps it, and null removes it
+	recorder = serveJSON(router, "PATCH", "/test-ad/"+id, `{"title": "test AD renamed"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	ad, err = store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.NotNil(t, ad.Schedule)
+	recorder = serveJSON(router, "PATCH", "/test-ad/"+id, `{"schedule": null}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	ad, err = store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Nil(t, ad.Schedule)
+}
+
+// define a store where another request moves startAt right after the ad is read
+type racingStore struct {
+	*storage.MemoryStore
+}
+
+func (s racingStore) Get(ctx context.Context, id string) (storage.File, error) {
+	ad, err := s.MemoryStore.Get(ctx, id)
+	if err == nil {
+		moved := ad
+		moved.StartAt = ad.EndAt.Add(-time.Hour)
+		err = s.MemoryStore.Update(ctx, id, moved)
+	}
+	return ad, err
+}
+
+// test processpatch refuses to write on an ad changed after it was checked, so the ad never ends before it starts
+func TestProcessPatch_Conflict(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PATCH("/test-ad/:id", process.NewHandler(racingStore{store}).ProcessPatch)
+
+	recorder := serveJSON(router, "PATCH", "/test-ad/"+id, `{"endAt": "2024-02-21T16:00:00.000Z"}`)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "ad_changed")
+
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.True(t, ad.StartAt.Before(ad.EndAt))
+}
+
+// test processpatch can not remove a required field
+func TestProcessPatch_Title(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PATCH("/test-ad/:id", process.NewHandler(store).ProcessPatch)
+
+	recorder := serveJSON(router, "PATCH", "/test-ad/"+id, "{\"title\": \"\"}")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// the stored ad is kept
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD", ad.Title)
+}
+
+// test processpatch with an ad which does not exist
+func TestProcessPatch_NotFound(t *testing.T) {
+	store, _ := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PATCH("/test-ad/:id", process.NewHandler(store).ProcessPatch)
+
+	recorder := serveJSON(router, "PATCH", "/test-ad/not-exist", "{\"title\": \"test AD fixed\"}")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
@@ -1,75 +1,48 @@
 package process
 
 import (
-	"errors"
-	"log"
 	"net/http"
-	"time"
 
+	"dcard/apperr"
 	"dcard/storage"
+	"dcard/tracing"
 
 	"github.com/gin-gonic/gin"
 )
 
-func ProcessPost(c *gin.Context) {
+func (h *Handler) ProcessPost(c *gin.Context) {
 	var ad storage.AdData
 
-	// parse the data into json struct
-	if err := c.ShouldBindJSON(&ad.Ad); err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// parse the data into json struct and check the required fields of the ad
+	if err := bindAd(c, &ad.Ad); err != nil {
+		respondError(c, err)
 		return
 	}
 
-	// if title is nil, return an error
-	if ad.Ad.Title == "" {
-		err := errors.New("title is nil")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	// record the clientIP and headers
+	ad.ClientIP = c.ClientIP()
+	ad.Headers = requestHeaders(c)
 
-	// if start and end is nil, return an error
-	if ad.Ad.StartAt == (time.Time{}) {
-		err := errors.New("start time is nil")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	if ad.Ad.EndAt == (time.Time{}) {
-		err := errors.New("end time is nil")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// call store function to store data
+	ctx, cancel := operationContext(c, h.timeouts.Write)
+	defer cancel()
+	id, err := storage.StoreData(ctx, h.store, ad)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	// if condition is not set, give it an all nil condition
-	if len(ad.Ad.Conditions) == 0 {
-		ad.Ad.Conditions = append(ad.Ad.Conditions, storage.Condition{
-			AgeStart: 0,
-			AgeEnd:   0,
-			Gender:   []string{},
-			Country:  []string{},
-			Platform: []string{},
-		})
-	}
-
-	// record the clientIP
-	ad.ClientIP = c.ClientIP()
+	// return a success feedback with the id of the ad, the keys are fixed so a title can not hide the id
+	c.JSON(http.StatusOK, gin.H{"id": id, "message": "POST successfully"})
+}
 
-	// record the clientIP
-	ad.Headers = make(map[string][]string)
-	for key, vals := range c.Request.Header {
-		ad.Headers[key] = make([]string, 0)
-		ad.Headers[key] = append(ad.Headers[key], vals...)
-	}
+// parse the body into the ad and check its required fields, in a span of its own so the parsing is told apart from the store
+func bindAd(c *gin.Context, ad *storage.File) (err error) {
+	_, span := tracing.Start(c.Request.Context(), "parse ad")
+	defer func() { tracing.End(span, err) }()
 
-	// call store function to store data
-	if err := storage.StoreData(ad); err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(ad); err != nil {
+		return apperr.Wrap(apperr.Validation, "invalid_body", "request body is not a valid ad", err)
 	}
-
-	// return a success feedback
-	c.JSON(http.StatusOK, gin.H{ad.Ad.Title: "POST successfully"})
+	return checkAd(ad)
 }
@@ -3,89 +3,24 @@ package process_test
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
-	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
-	"time"
 
-	"dcard/storage"
+	"dcard/process"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/assert/v2"
 )
 
-func ProcessPost(c *gin.Context) {
-	var ad storage.AdData
-
-	// parse the data into json struct
-	if err := c.ShouldBindJSON(&ad.Ad); err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// if title is nil, return an error
-	if ad.Ad.Title == "" {
-		err := errors.New("title is nil")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// if start and end is nil, return an error
-	if ad.Ad.StartAt == (time.Time{}) {
-		err := errors.New("start time is nil")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	if ad.Ad.EndAt == (time.Time{}) {
-		err := errors.New("end time is nil")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// if condition is not set, give it an all nil condition
-	if len(ad.Ad.Conditions) == 0 {
-		ad.Ad.Conditions = append(ad.Ad.Conditions, storage.Condition{
-			AgeStart: 0,
-			AgeEnd:   0,
-			Gender:   []string{},
-			Country:  []string{},
-			Platform: []string{},
-		})
-	}
-
-	// record the clientIP
-	ad.ClientIP = c.ClientIP()
-
-	// record the clientIP
-	ad.Headers = make(map[string][]string)
-	for key, vals := range c.Request.Header {
-		ad.Headers[key] = make([]string, 0)
-		ad.Headers[key] = append(ad.Headers[key], vals...)
-	}
-
-	// call store function to store data
-	// if err := storage.StoreData(ad); err != nil {
-	// 	log.Println(err)
-	// 	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-	// }
-
-	// return a success feedback
-	c.JSON(http.StatusOK, gin.H{ad.Ad.Title: "POST successfully"})
-}
-
 // test processpost with nil title
 func TestProcessPost_Title(t *testing.T) {
 	// Create a new Gin router
 	router := gin.Default()
 
 	// Set up the endpoint handler
-	router.POST("/test-title", ProcessPost)
+	router.POST("/test-title", newTestHandler().ProcessPost)
 
 	// Create a request body with nil title
 	requestBody := string("{\"startAt\": \"2024-01-21T16:00:00.000Z\", \"endAt\": \"2024-06-21T16:00:00.000Z\"}")
@@ -104,17 +39,19 @@ func TestProcessPost_Title(t *testing.T) {
 	router.ServeHTTP(recorder, req)
 
 	// Check the response status code
-	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
 
 	// Decode the response body
-	var responseBody map[string]string
+	var responseBody errorBody
 	err = json.Unmarshal(recorder.Body.Bytes(), &responseBody)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Check if the error message is as expected
-	assert.Equal(t, "title is nil", responseBody["error"])
+	assert.Equal(t, "title is nil", responseBody.Error.Message)
+	assert.Equal(t, "title", responseBody.Error.Field)
+	assert.Equal(t, "required", responseBody.Error.Code)
 }
 
 // test processpost with nil start time
@@ -123,7 +60,7 @@ func TestProcessPost_StartTime(t *testing.T) {
 	router := gin.Default()
 
 	// Set up the endpoint handler
-	router.POST("/test-start", ProcessPost)
+	router.POST("/test-start", newTestHandler().ProcessPost)
 
 	// Create a request body with nil title
 	requestBody := string("{\"title\": \"test AD\",\"endAt\": \"2024-06-21T16:00:00.000Z\"}")
@@ -142,17 +79,19 @@ func TestProcessPost_StartTime(t *testing.T) {
 	router.ServeHTTP(recorder, req)
 
 	// Check the response status code
-	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
 
 	// Decode the response body
-	var responseBody map[string]string
+	var responseBody errorBody
 	err = json.Unmarshal(recorder.Body.Bytes(), &responseBody)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Check if the error message is as expected
-	assert.Equal(t, "start time is nil", responseBody["error"])
+	assert.Equal(t, "start time is nil", responseBody.Error.Message)
+	assert.Equal(t, "startAt", responseBody.Error.Field)
+	assert.Equal(t, "required", responseBody.Error.Code)
 }
 
 // test processpost with nil start time
@@ -161,7 +100,7 @@ func TestProcessPost_EndTime(t *testing.T) {
 	router := gin.Default()
 
 	// Set up the endpoint handler
-	router.POST("/test-end", ProcessPost)
+	router.POST("/test-end", newTestHandler().ProcessPost)
 
 	// Create a request body with nil title
 	requestBody := string("{\"title\": \"test AD\",\"startAt\": \"2024-01-21T16:00:00.000Z\"}")
@@ -180,17 +119,19 @@ func TestProcessPost_EndTime(t *testing.T) {
 	router.ServeHTTP(recorder, req)
 
 	// Check the response status code
-	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
 
 	// Decode the response body
-	var responseBody map[string]string
+	var responseBody errorBody
 	err = json.Unmarshal(recorder.Body.Bytes(), &responseBody)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Check if the error message is as expected
-	assert.Equal(t, "end time is nil", responseBody["error"])
+	assert.Equal(t, "end time is nil", responseBody.Error.Message)
+	assert.Equal(t, "endAt", responseBody.Error.Field)
+	assert.Equal(t, "required", responseBody.Error.Code)
 }
 
 // test processpost success
@@ -199,7 +140,7 @@ func TestProcess_Success(t *testing.T) {
 	router := gin.Default()
 
 	// Set up the endpoint handler
-	router.POST("/test-success", ProcessPost)
+	router.POST("/test-success", newTestHandler().ProcessPost)
 
 	// Create a request body with nil title
 	requestBody := string("{\"Title\": \"test AD\", \"startAt\": \"2024-01-21T16:00:00.000Z\", \"endAt\": \"2024-06-21T16:00:00.000Z\"}")
@@ -221,5 +162,164 @@ func TestProcess_Success(t *testing.T) {
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
 	// Check if the error message is as expected
-	assert.Equal(t, "{\"test AD\":\"POST successfully\"}", recorder.Body.String())
+	assert.Equal(t, "{\"id\":\"fake-id\",\"message\":\"POST successfully\"}", recorder.Body.String())
+}
+
+// test processpost reports every violation of the ad at once
+func TestProcessPost_Violations(t *testing.T) {
+	router := gin.Default()
+	router.POST("/test-violations", newTestHandler().ProcessPost)
+
+	// the title is missing, the ad ends before it starts and every condition field is invalid
+	requestBody := `{"startAt": "2024-06-21T16:00:00.000Z", "endAt": "2024-01-21T16:00:00.000Z", "conditions": [
+		{"ageStart": 30, "ageEnd": 101, "gender": ["M", "X"], "country": ["TW", "TWN", "TW"], "platform": ["ios", "windows"]}]}`
+	recorder := serveJSON(router, "POST", "/test-violations", requestBody)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	var responseBody errorBody
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first violation is also the offending field
+	assert.Equal(t, "title", responseBody.Error.Field)
+	assert.Equal(t, "required", responseBody.Error.Code)
+
+	var got []string
+	for _, violation := range responseBody.Error.Violations {
+		got = append(got, violation.Field+":"+violation.Code)
+	}
+	assert.Equal(t, []string{
+		"title:required",
+		"endAt:invalid_range",
+		"conditions[0].ageEnd:out_of_range",
+		"conditions[0].gender[1]:invalid_value",
+		"conditions[0].country[1]:invalid_value",
+		"conditions[0].country[2]:duplicate",
+		"conditions[0].platform[1]:invalid_value",
+	}, got)
+}
+
+// test processpost checks each rule of the ad
+func TestProcessPost_Rules(t *testing.T) {
+	router := gin.Default()
+	router.POST("/test-rules", newTestHandler().ProcessPost)
+
+	tests := []struct {
+		name   string
+		ad     string
+		status int
+		field  string
+		code   string
+	}{
+		{"valid conditions", `"conditions": [{"ageStart": 1, "ageEnd": 100, "gender": ["M", "F"], "country": ["TW", "JP"], "platform": ["android", "ios", "web"]}]`, http.StatusOK, "", ""},
+		{"any age", `"conditions": [{"ageStart": 0, "ageEnd": 0}]`, http.StatusOK, "", ""},
+		{"start after end of age", `"conditions": [{"ageStart": 40, "ageEnd": 20}]`, http.StatusBadRequest, "conditions[0].ageEnd", "invalid_range"},
+		{"age start below range", `"conditions": [{"ageStart": 0, "ageEnd": 20}]`, http.StatusBadRequest, "conditions[0].ageStart", "out_of_range"},
+		{"lowercase country", `"conditions": [{"country": ["tw"]}]`, http.StatusBadRequest, "conditions[0].country[0]", "invalid_value"},
+		{"duplicate gender", `"conditions": [{"gender": ["F", "F"]}]`, http.StatusBadRequest, "conditions[0].gender[1]", "duplicate"},
+		{"second condition", `"conditions": [{}, {"platform": ["ios", "ios"]}]`, http.StatusBadRequest, "conditions[1].platform[1]", "duplicate"},
+		{"valid exclusions", `"conditions": [{"gender": ["F"], "excludeCountry": ["CN"], "excludePlatform": ["android"]}]`, http.StatusOK, "", ""},
+		{"invalid excluded country", `"conditions": [{"excludeCountry": ["CHN"]}]`, http.StatusBadRequest, "conditions[0].excludeCountry[0]", "invalid_value"},
+		{"duplicate excluded gender", `"conditions": [{"excludeGender": ["M", "M"]}]`, http.StatusBadRequest, "conditions[0].excludeGender[1]", "duplicate"},
+		{"included and excluded platform", `"conditions": [{"platform": ["ios", "web"], "excludePlatform": ["android", "web"]}]`, http.StatusBadRequest, "conditions[0].excludePlatform[1]", "contradiction"},
+		{"open-ended ages", `"conditions": [{"ages": [{"max": 24}, {"min": 60}]}]`, http.StatusOK, "", ""},
+		{"ages with legacy range", `"conditions": [{"ageStart": 20, "ageEnd": 30, "ages": [{"min": 18}]}]`, http.StatusBadRequest, "conditions[0].ages", "conflict"},
+		{"age range without bound", `"conditions": [{"ages": [{}]}]`, http.StatusBadRequest, "conditions[0].ages[0]", "required"},
+		{"age range above interval", `"conditions": [{"ages": [{"min": 101}]}]`, http.StatusBadRequest, "conditions[0].ages[0].min", "out_of_range"},
+		{"age range min after max", `"conditions": [{"ages": [{"min": 40, "max": 20}]}]`, http.StatusBadRequest, "conditions[0].ages[0].max", "invalid_range"},
+		{"overlapping age ranges", `"conditions": [{"ages": [{"min": 30}, {"min": 18, "max": 25}, {"min": 20, "max": 29}]}]`, http.StatusBadRequest, "conditions[0].ages[2]", "overlap"},
+		{"evening schedule", `"schedule": {"timeZone": "Asia/Taipei", "days": ["mon", "tue", "wed", "thu", "fri"], "hours": [{"start": 18, "end": 23}]}`, http.StatusOK, "", ""},
+		{"schedule without time zone", `"schedule": {"hours": [{"start": 18, "end": 23}]}`, http.StatusBadRequest, "schedule.timeZone", "required"},
+		{"unknown time zone", `"schedule": {"timeZone": "Asia/Taipe"}`, http.StatusBadRequest, "schedule.timeZone", "invalid_value"},
+		{"host time zone", `"schedule": {"timeZone": "Local"}`, http.StatusBadRequest, "schedule.timeZone", "invalid_value"},
+		{"unknown day", `"schedule": {"timeZone": "UTC", "days": ["monday"]}`, http.StatusBadRequest, "schedule.days[0]", "invalid_value"},
+		{"hour above a day", `"schedule": {"timeZone": "UTC", "hours": [{"start": 18, "end": 25}]}`, http.StatusBadRequest, "schedule.hours[0].end", "out_of_range"},
+		{"hour range ends before it starts", `"schedule": {"timeZone": "UTC", "hours": [{"start": 23, "end": 18}]}`, http.StatusBadRequest, "schedule.hours[0].end", "invalid_range"},
+		{"overlapping hour ranges", `"schedule": {"timeZone": "UTC", "hours": [{"start": 18, "end": 23}, {"start": 7, "end": 19}]}`, http.StatusBadRequest, "schedule.hours[0]", "overlap"},
+		{"adjacent hour ranges", `"schedule": {"timeZone": "UTC", "hours": [{"start": 20, "end": 23}, {"start": 18, "end": 20}]}`, http.StatusOK, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestBody := `{"title": "test AD", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z", ` + test.ad + `}`
+			recorder := serveJSON(router, "POST", "/test-rules", requestBody)
+			assert.Equal(t, test.status, recorder.Code)
+			if test.status == http.StatusOK {
+				return
+			}
+
+			var responseBody errorBody
+			if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, test.field, responseBody.Error.Field)
+			assert.Equal(t, test.code, responseBody.Error.Code)
+		})
+	}
+}
+
+// test processpost limits the length of the title and checks the time range
+func TestProcessPost_TitleAndTime(t *testing.T) {
+	router := gin.Default()
+	router.POST("/test-title-time", newTestHandler().ProcessPost)
+
+	// a title of 101 characters is too long, even when they are multibyte
+	requestBody := `{"title": "` + strings.Repeat("廣", 101) + `", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z"}`
+	recorder := serveJSON(router, "POST", "/test-title-time", requestBody)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	var responseBody errorBody
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "title", responseBody.Error.Field)
+	assert.Equal(t, "too_long", responseBody.Error.Code)
+
+	// a title of 100 characters is fine
+	requestBody = `{"title": "` + strings.Repeat("廣", 100) + `", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z"}`
+	recorder = serveJSON(router, "POST", "/test-title-time", requestBody)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// an ad which ends when it starts is invalid
+	requestBody = `{"title": "test AD", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-01-21T16:00:00.000Z"}`
+	recorder = serveJSON(router, "POST", "/test-title-time", requestBody)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "endAt", responseBody.Error.Field)
+	assert.Equal(t, "invalid_range", responseBody.Error.Code)
+}
+
+// test processpost writes the legacy age range as an age range, and keeps 0 and 0 as any age
+func TestProcessPost_Ages(t *testing.T) {
+	store := &fakeStore{}
+	router := gin.Default()
+	router.POST("/test-ages", process.NewHandler(store).ProcessPost)
+
+	requestBody := `{"title": "test AD", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z",
+		"conditions": [{"ageStart": 20, "ageEnd": 30}, {"ageStart": 0, "ageEnd": 0}]}`
+	recorder := serveJSON(router, "POST", "/test-ages", requestBody)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if len(store.ads) != 1 {
+		t.Fatalf("Expected 1 stored ad, got %d", len(store.ads))
+	}
+
+	conditions := store.ads[0].Conditions
+	assert.Equal(t, 0, conditions[0].AgeStart)
+	assert.Equal(t, 0, conditions[0].AgeEnd)
+	assert.Equal(t, 1, len(conditions[0].Ages))
+	assert.Equal(t, 20, *conditions[0].Ages[0].Min)
+	assert.Equal(t, 30, *conditions[0].Ages[0].Max)
+	assert.Equal(t, 0, len(conditions[1].Ages))
+}
+
+// test processpost keeps the id in the response even when the title is id
+func TestProcessPost_TitleID(t *testing.T) {
+	router := gin.Default()
+	router.POST("/test-title-id", newTestHandler().ProcessPost)
+
+	requestBody := `{"title": "id", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z"}`
+	recorder := serveJSON(router, "POST", "/test-title-id", requestBody)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"id":"fake-id","message":"POST successfully"}`, recorder.Body.String())
 }
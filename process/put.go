@@ -0,0 +1,36 @@
+package process
+
+import (
+	"net/http"
+
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) ProcessPut(c *gin.Context) {
+	var ad storage.AdData
+	id := c.Param("id")
+
+	// parse the data into json struct and check the required fields of the ad
+	if err := bindAd(c, &ad.Ad); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// record the clientIP and headers
+	ad.ClientIP = c.ClientIP()
+	ad.Headers = requestHeaders(c)
+
+	// call store function to replace the ad
+	ctx, cancel := operationContext(c, h.timeouts.Write)
+	defer cancel()
+	if err := storage.UpdateData(ctx, h.store, id, ad); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// return the replaced ad
+	ad.Ad.ID = id
+	c.JSON(http.StatusOK, ad.Ad)
+}
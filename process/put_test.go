@@ -0,0 +1,67 @@
+package process_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"dcard/process"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// test processput replaces the whole ad
+func TestProcessPut(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PUT("/test-ad/:id", process.NewHandler(store).ProcessPut)
+
+	// replace the ad without condition
+	requestBody := string("{\"title\": \"test AD replaced\", \"startAt\": \"2024-02-21T16:00:00.000Z\", \"endAt\": \"2024-07-21T16:00:00.000Z\"}")
+	recorder := serveJSON(router, "PUT", "/test-ad/"+id, requestBody)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var responseBody storage.File
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, id, responseBody.ID)
+	assert.Equal(t, "test AD replaced", responseBody.Title)
+
+	// the stored ad is replaced, and the conditions fall back to the all nil condition
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD replaced", ad.Title)
+	assert.Equal(t, 1, len(ad.Conditions))
+	assert.Equal(t, 0, len(ad.Conditions[0].Country))
+}
+
+// test processput with a missing title
+func TestProcessPut_Title(t *testing.T) {
+	store, id := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PUT("/test-ad/:id", process.NewHandler(store).ProcessPut)
+
+	requestBody := string("{\"startAt\": \"2024-02-21T16:00:00.000Z\", \"endAt\": \"2024-07-21T16:00:00.000Z\"}")
+	recorder := serveJSON(router, "PUT", "/test-ad/"+id, requestBody)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// the stored ad is kept
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD", ad.Title)
+}
+
+// test processput with an ad which does not exist
+func TestProcessPut_NotFound(t *testing.T) {
+	store, _ := newTestStoreWithAd(t)
+	router := gin.Default()
+	router.PUT("/test-ad/:id", process.NewHandler(store).ProcessPut)
+
+	requestBody := string("{\"title\": \"test AD\", \"startAt\": \"2024-02-21T16:00:00.000Z\", \"endAt\": \"2024-07-21T16:00:00.000Z\"}")
+	recorder := serveJSON(router, "PUT", "/test-ad/not-exist", requestBody)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
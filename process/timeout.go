@@ -0,0 +1,40 @@
+package process
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// define the longest time each kind of store operation may take, a zero timeout only ends with the request
+type Timeouts struct {
+	// the GET of a page of ads
+	Query time.Duration
+	// the GET of a single ad
+	Get time.Duration
+	// the POST, PUT, PATCH and DELETE of an ad
+	Write time.Duration
+	// the GET of the usage of the quota
+	Usage time.Duration
+	// the check of the store by the readiness check
+	Ready time.Duration
+}
+
+// the timeouts of a handler established without any
+var DefaultTimeouts = Timeouts{Query: 2 * time.Second, Get: time.Second, Write: 3 * time.Second, Usage: 2 * time.Second, Ready: time.Second}
+
+// bound the store operations of the handler by the given timeouts
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(h *Handler) {
+		h.timeouts = timeouts
+	}
+}
+
+// derive the context of a store operation from the request, it ends when the client goes away or the timeout is hit
+func operationContext(c *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(c.Request.Context())
+	}
+	return context.WithTimeout(c.Request.Context(), timeout)
+}
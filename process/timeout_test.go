@@ -0,0 +1,85 @@
+package process_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dcard/process"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// define an ad store which hangs like an unresponsive mongod, every query and insert waits until its context ends
+type hangingStore struct {
+	fakeStore
+}
+
+func (s *hangingStore) Insert(ctx context.Context, _ storage.File) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (s *hangingStore) Query(ctx context.Context, _ storage.QueryRequest) ([]storage.File, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *hangingStore) Ping(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// register the POST and the GET of a handler on the hanging store
+func newHangingRouter(opts ...process.Option) *gin.Engine {
+	router := gin.Default()
+	handler := process.NewHandler(&hangingStore{}, opts...)
+	router.POST("/test-timeout", handler.ProcessPost)
+	router.GET("/test-timeout", handler.ProcessGet)
+	return router
+}
+
+// decode the code of the error response
+func errorCode(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	var responseBody errorBody
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatalf("Expected a json error body, got %s", recorder.Body.String())
+	}
+	return responseBody.Error.Code
+}
+
+// test a store operation which does not finish within its timeout is answered with 504
+func TestProcess_Timeout(t *testing.T) {
+	router := newHangingRouter(process.WithTimeouts(process.Timeouts{Query: 20 * time.Millisecond, Write: 50 * time.Millisecond}))
+
+	start := time.Now()
+	recorder := serveJSON(router, "GET", "/test-timeout?offset=1", "")
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Equal(t, "timeout", errorCode(t, recorder))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// each kind of operation has its own timeout
+	start = time.Now()
+	requestBody := `{"title": "test AD", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z"}`
+	recorder = serveJSON(router, "POST", "/test-timeout", requestBody)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+// test the store operation ends with the request when the client goes away, even without a timeout
+func TestProcess_Canceled(t *testing.T) {
+	router := newHangingRouter(process.WithTimeouts(process.Timeouts{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/test-timeout?offset=1", nil)
+	recorder := httptest.NewRecorder()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "canceled", errorCode(t, recorder))
+}
@@ -0,0 +1,23 @@
+package process
+
+import (
+	"net/http"
+
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) ProcessUsage(c *gin.Context) {
+	// call store function to get the usage of the quota
+	ctx, cancel := operationContext(c, h.timeouts.Usage)
+	defer cancel()
+	usage, err := storage.UsageData(ctx, h.store)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// return the ads created today and the ads active now with their limits
+	c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,107 @@
+package process_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"dcard/apperr"
+	"dcard/process"
+	"dcard/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// define the json body of an exceeded quota
+type quotaBody struct {
+	Error struct {
+		Code    string         `json:"code"`
+		Details map[string]int `json:"details"`
+	} `json:"error"`
+}
+
+// post an ad flying during the given hours from now
+func postAd(router *gin.Engine, from, to int) int {
+	now := time.Now()
+	requestBody := `{"title": "test AD", "startAt": "` + now.Add(time.Duration(from)*time.Hour).Format(time.RFC3339) +
+		`", "endAt": "` + now.Add(time.Duration(to)*time.Hour).Format(time.RFC3339) + `"}`
+	return serveJSON(router, "POST", "/api/v1/ad", requestBody).Code
+}
+
+// test processpost returns 429 with the current counts when the daily quota is used up
+func TestProcessPost_DailyQuota(t *testing.T) {
+	store := storage.NewMemoryStore(storage.WithQuota(storage.Quota{DailyLimit: 2}))
+	router := gin.Default()
+	router.POST("/api/v1/ad", process.NewHandler(store).ProcessPost)
+
+	assert.Equal(t, http.StatusOK, postAd(router, 0, 1))
+	assert.Equal(t, http.StatusOK, postAd(router, 0, 1))
+
+	requestBody := `{"title": "test AD", "startAt": "2024-01-21T16:00:00.000Z", "endAt": "2024-06-21T16:00:00.000Z"}`
+	recorder := serveJSON(router, "POST", "/api/v1/ad", requestBody)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	var responseBody quotaBody
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "daily_quota_exceeded", responseBody.Error.Code)
+	assert.Equal(t, map[string]int{"limit": 2, "created": 2}, responseBody.Error.Details)
+}
+
+// test processpost returns 409 with the current counts when too many ads would be active at the same time
+func TestProcessPost_ActiveCap(t *testing.T) {
+	store := storage.NewMemoryStore(storage.WithQuota(storage.Quota{ActiveLimit: 2}))
+	router := gin.Default()
+	router.POST("/api/v1/ad", process.NewHandler(store).ProcessPost)
+
+	// two ads overlap during the second hour
+	assert.Equal(t, http.StatusOK, postAd(router, 0, 2))
+	assert.Equal(t, http.StatusOK, postAd(router, 1, 3))
+
+	// a third one overlapping both is rejected, one flying after them is fine
+	now := time.Now()
+	requestBody := `{"title": "test AD", "startAt": "` + now.Format(time.RFC3339) + `", "endAt": "` + now.Add(4*time.Hour).Format(time.RFC3339) + `"}`
+	recorder := serveJSON(router, "POST", "/api/v1/ad", requestBody)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	var responseBody quotaBody
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responseBody); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "active_cap_exceeded", responseBody.Error.Code)
+	assert.Equal(t, map[string]int{"limit": 2, "active": 2}, responseBody.Error.Details)
+	assert.Equal(t, http.StatusOK, postAd(router, 3, 4))
+}
+
+// test processusage returns the ads created today and the ads active now
+func TestProcessUsage(t *testing.T) {
+	store := storage.NewMemoryStore(storage.WithQuota(storage.Quota{DailyLimit: 10, ActiveLimit: 5}))
+	router := gin.Default()
+	handler := process.NewHandler(store)
+	router.POST("/api/v1/ad", handler.ProcessPost)
+	router.GET("/api/v1/admin/usage", handler.ProcessUsage)
+
+	// one ad is active now and the other one is scheduled
+	assert.Equal(t, http.StatusOK, postAd(router, -1, 1))
+	assert.Equal(t, http.StatusOK, postAd(router, 1, 2))
+
+	recorder := serveJSON(router, "GET", "/api/v1/admin/usage", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var usage storage.Usage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), usage.Date)
+	assert.Equal(t, 2, usage.Created)
+	assert.Equal(t, 10, usage.DailyLimit)
+	assert.Equal(t, 1, usage.Active)
+	assert.Equal(t, 5, usage.ActiveLimit)
+
+	// an error of the store is returned with its status
+	router = gin.Default()
+	router.GET("/api/v1/admin/usage", process.NewHandler(&fakeStore{err: apperr.Wrap(apperr.Unavailable, "store_unavailable", "the ad store is unavailable", errors.New("connection refused"))}).ProcessUsage)
+	recorder = serveJSON(router, "GET", "/api/v1/admin/usage", "")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
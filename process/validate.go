@@ -0,0 +1,251 @@
+package process
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"dcard/apperr"
+	"dcard/storage"
+)
+
+// the limits of an ad
+const (
+	maxTitleLength = 100
+	minAge         = 1
+	maxAge         = 100
+	hoursOfDay     = 24
+)
+
+// the allowed values of the condition lists
+var (
+	genders   = map[string]bool{"M": true, "F": true}
+	platforms = map[string]bool{"android": true, "ios": true, "web": true}
+	weekdays  = map[string]bool{"sun": true, "mon": true, "tue": true, "wed": true, "thu": true, "fri": true, "sat": true}
+)
+
+// collect every violation of an ad, so the client can fix them all at once
+type violations []apperr.Violation
+
+func (v *violations) add(field, code, message string) {
+	*v = append(*v, apperr.Violation{Field: field, Code: code, Message: message})
+}
+
+// check every field of the ad, and give it an all nil condition when it has none
+func checkAd(ad *storage.File) error {
+	var v violations
+
+	// the title is required and has a length limit
+	if strings.TrimSpace(ad.Title) == "" {
+		v.add("title", "required", "title is nil")
+	} else if utf8.RuneCountInString(ad.Title) > maxTitleLength {
+		v.add("title", "too_long", fmt.Sprintf("title should be at most %d characters", maxTitleLength))
+	}
+
+	// the start and end time are required, and the ad should end after it starts
+	if ad.StartAt == (time.Time{}) {
+		v.add("startAt", "required", "start time is nil")
+	}
+	if ad.EndAt == (time.Time{}) {
+		v.add("endAt", "required", "end time is nil")
+	}
+	if ad.StartAt != (time.Time{}) && ad.EndAt != (time.Time{}) && !ad.StartAt.Before(ad.EndAt) {
+		v.add("endAt", "invalid_range", "end time should be after start time")
+	}
+
+	for i, condition := range ad.Conditions {
+		checkCondition(&v, fmt.Sprintf("conditions[%d]", i), condition)
+	}
+	if ad.Schedule != nil {
+		checkSchedule(&v, "schedule", *ad.Schedule)
+	}
+	if len(v) > 0 {
+		return apperr.NewViolations(v)
+	}
+
+	// the legacy age range is written as an age range, so only the ads stored before keep it
+	for i := range ad.Conditions {
+		migrateAges(&ad.Conditions[i])
+	}
+
+	// if condition is not set, give it an all nil condition
+	if len(ad.Conditions) == 0 {
+		ad.Conditions = append(ad.Conditions, storage.Condition{
+			AgeStart: 0,
+			AgeEnd:   0,
+			Gender:   []string{},
+			Country:  []string{},
+			Platform: []string{},
+		})
+	}
+	return nil
+}
+
+// check the age ranges and the lists of a condition, a legacy age range of 0 and 0 means any age
+func checkCondition(v *violations, prefix string, condition storage.Condition) {
+	if len(condition.Ages) > 0 && (condition.AgeStart != 0 || condition.AgeEnd != 0) {
+		v.add(prefix+".ages", "conflict", "ages should not be set with ageStart and ageEnd")
+	}
+	checkAges(v, prefix+".ages", condition.Ages)
+	if condition.AgeStart != 0 || condition.AgeEnd != 0 {
+		ageRange := fmt.Sprintf("age should be in this interval: [%d, %d]", minAge, maxAge)
+		if condition.AgeStart < minAge || condition.AgeStart > maxAge {
+			v.add(prefix+".ageStart", "out_of_range", ageRange)
+		}
+		if condition.AgeEnd < minAge || condition.AgeEnd > maxAge {
+			v.add(prefix+".ageEnd", "out_of_range", ageRange)
+		}
+		if condition.AgeStart > condition.AgeEnd {
+			v.add(prefix+".ageEnd", "invalid_range", "ageEnd should not be less than ageStart")
+		}
+	}
+
+	isGender := func(gender string) bool { return genders[gender] }
+	isCountry := func(country string) bool { return countryCodes[country] }
+	isPlatform := func(platform string) bool { return platforms[platform] }
+	checkList(v, prefix+".gender", condition.Gender, isGender, "gender should be M or F")
+	checkList(v, prefix+".country", condition.Country, isCountry, "country should be an iso 3166-1 alpha-2 code")
+	checkList(v, prefix+".platform", condition.Platform, isPlatform, "platform should be android, ios or web")
+	checkList(v, prefix+".excludeGender", condition.ExcludeGender, isGender, "gender should be M or F")
+	checkList(v, prefix+".excludeCountry", condition.ExcludeCountry, isCountry, "country should be an iso 3166-1 alpha-2 code")
+	checkList(v, prefix+".excludePlatform", condition.ExcludePlatform, isPlatform, "platform should be android, ios or web")
+	checkExclude(v, prefix+".excludeGender", condition.Gender, condition.ExcludeGender)
+	checkExclude(v, prefix+".excludeCountry", condition.Country, condition.ExcludeCountry)
+	checkExclude(v, prefix+".excludePlatform", condition.Platform, condition.ExcludePlatform)
+}
+
+// check each age range has a bound in the interval, and the ranges do not overlap
+func checkAges(v *violations, field string, ages []storage.AgeRange) {
+	ageRange := fmt.Sprintf("age should be in this interval: [%d, %d]", minAge, maxAge)
+	valid := make([]int, 0, len(ages))
+	for i, r := range ages {
+		prefix := fmt.Sprintf("%s[%d]", field, i)
+		ok := true
+		if r.Min == nil && r.Max == nil {
+			v.add(prefix, "required", "min or max should be set")
+			ok = false
+		}
+		if r.Min != nil && (*r.Min < minAge || *r.Min > maxAge) {
+			v.add(prefix+".min", "out_of_range", ageRange)
+			ok = false
+		}
+		if r.Max != nil && (*r.Max < minAge || *r.Max > maxAge) {
+			v.add(prefix+".max", "out_of_range", ageRange)
+			ok = false
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			v.add(prefix+".max", "invalid_range", "max should not be less than min")
+			ok = false
+		}
+		if ok {
+			valid = append(valid, i)
+		}
+	}
+
+	// an open bound reaches the end of the interval
+	bounds := func(r storage.AgeRange) (int, int) {
+		from, to := minAge, maxAge
+		if r.Min != nil {
+			from = *r.Min
+		}
+		if r.Max != nil {
+			to = *r.Max
+		}
+		return from, to
+	}
+	sort.SliceStable(valid, func(a, b int) bool {
+		from, _ := bounds(ages[valid[a]])
+		other, _ := bounds(ages[valid[b]])
+		return from < other
+	})
+	reached := minAge - 1
+	for _, i := range valid {
+		from, to := bounds(ages[i])
+		if from <= reached {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "overlap", "age ranges should not overlap")
+		}
+		reached = max(reached, to)
+	}
+}
+
+// check the time zone, the days and the hour ranges of a schedule, the hour ranges do not overlap
+func checkSchedule(v *violations, prefix string, schedule storage.Schedule) {
+	// local is the zone of the host, which is not an iana time zone
+	if schedule.TimeZone == "" {
+		v.add(prefix+".timeZone", "required", "time zone is nil")
+	} else if _, err := time.LoadLocation(schedule.TimeZone); err != nil || schedule.TimeZone == "Local" {
+		v.add(prefix+".timeZone", "invalid_value", "time zone should be an iana time zone like Asia/Taipei")
+	}
+
+	checkList(v, prefix+".days", schedule.Days, func(day string) bool { return weekdays[day] }, "day should be sun, mon, tue, wed, thu, fri or sat")
+
+	valid := make([]int, 0, len(schedule.Hours))
+	for i, r := range schedule.Hours {
+		field := fmt.Sprintf("%s.hours[%d]", prefix, i)
+		ok := true
+		if r.Start < 0 || r.Start >= hoursOfDay {
+			v.add(field+".start", "out_of_range", fmt.Sprintf("start should be in this interval: [0, %d]", hoursOfDay-1))
+			ok = false
+		}
+		if r.End < 1 || r.End > hoursOfDay {
+			v.add(field+".end", "out_of_range", fmt.Sprintf("end should be in this interval: [1, %d]", hoursOfDay))
+			ok = false
+		}
+		if r.Start >= r.End {
+			v.add(field+".end", "invalid_range", "end should be after start")
+			ok = false
+		}
+		if ok {
+			valid = append(valid, i)
+		}
+	}
+
+	// the end hour is not in the range, so 18 to 20 and 20 to 23 do not overlap
+	sort.SliceStable(valid, func(a, b int) bool { return schedule.Hours[valid[a]].Start < schedule.Hours[valid[b]].Start })
+	reached := 0
+	for _, i := range valid {
+		if schedule.Hours[i].Start < reached {
+			v.add(fmt.Sprintf("%s.hours[%d]", prefix, i), "overlap", "hour ranges should not overlap")
+		}
+		reached = max(reached, schedule.Hours[i].End)
+	}
+}
+
+// write the legacy age range of the condition as an age range, 0 and 0 stays as any age
+func migrateAges(condition *storage.Condition) {
+	if condition.AgeStart == 0 && condition.AgeEnd == 0 {
+		return
+	}
+	from, to := condition.AgeStart, condition.AgeEnd
+	condition.Ages = []storage.AgeRange{{Min: &from, Max: &to}}
+	condition.AgeStart, condition.AgeEnd = 0, 0
+}
+
+// check every value of a list is allowed and appears only once
+func checkList(v *violations, field string, values []string, allowed func(string) bool, message string) {
+	seen := make(map[string]bool, len(values))
+	for i, value := range values {
+		if !allowed(value) {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "invalid_value", message)
+		}
+		if seen[value] {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "duplicate", fmt.Sprintf("%s appears more than once", value))
+		}
+		seen[value] = true
+	}
+}
+
+// check no value is both included and excluded, such a value could never be matched
+func checkExclude(v *violations, field string, include, exclude []string) {
+	included := make(map[string]bool, len(include))
+	for _, value := range include {
+		included[value] = true
+	}
+	for i, value := range exclude {
+		if included[value] {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "contradiction", fmt.Sprintf("%s is both included and excluded", value))
+		}
+	}
+}
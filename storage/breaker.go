@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"dcard/apperr"
+	"dcard/metrics"
+)
+
+// define the circuit breaker around mongodb, a zero threshold never opens it
+type BreakerOptions struct {
+	// the consecutive failed operations which open the breaker
+	Threshold int
+	// how long the breaker stays open before a single operation is let through to probe mongodb
+	Cooldown time.Duration
+}
+
+// the states of the circuit breaker, the values are the ones of the state gauge
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// the error of an operation failed fast while the breaker is open
+var errCircuitOpen = apperr.New(apperr.Unavailable, "store_circuit_open", "the ad store is failing, try again later")
+
+// define the circuit breaker, it opens after the threshold of consecutive failures so the requests fail fast instead of
+// piling up on a mongod which is down, and closes again once a probe after the cooldown succeeds
+type breaker struct {
+	opts BreakerOptions
+	now  func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// establish a closed breaker
+func newBreaker(opts BreakerOptions) *breaker {
+	metrics.MongoCircuitState.Set(float64(breakerClosed))
+	return &breaker{opts: opts, now: time.Now}
+}
+
+// check if an operation may be sent, only a single probe is let through once the cooldown has passed, a nil breaker
+// never opens
+func (b *breaker) allow() error {
+	if b == nil || b.opts.Threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.opts.Cooldown {
+			return errCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// the probe is still in flight
+		return errCircuitOpen
+	default:
+		return nil
+	}
+}
+
+// record the result of an operation let through, a transient error or a deadline hit is a failure and a failed probe
+// opens the breaker again, while an operation canceled by its client tells nothing about mongodb
+func (b *breaker) record(err error) {
+	if b == nil || b.opts.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case errors.Is(err, context.Canceled):
+		// let the next operation probe instead, the cooldown has already passed
+		if b.state == breakerHalfOpen {
+			b.setState(breakerOpen)
+		}
+	case isTransient(err) || errors.Is(err, context.DeadlineExceeded):
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.opts.Threshold {
+			b.openedAt = b.now()
+			b.setState(breakerOpen)
+		}
+	default:
+		b.failures = 0
+		b.setState(breakerClosed)
+	}
+}
+
+// change the state and log the transitions
+func (b *breaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	switch state {
+	case breakerOpen:
+		slog.Warn("Open the circuit breaker of MongoDB", "failures", b.failures, "cooldown", b.opts.Cooldown.String())
+	case breakerClosed:
+		slog.Info("Close the circuit breaker of MongoDB")
+	}
+	b.state = state
+	metrics.MongoCircuitState.Set(float64(state))
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"dcard/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// establish a breaker on a fake clock
+func newTestBreaker(threshold int, cooldown time.Duration) (*breaker, *fakeClock) {
+	clock := newFakeClock(time.Now())
+	b := newBreaker(BreakerOptions{Threshold: threshold, Cooldown: cooldown})
+	b.now = clock.Now
+	return b, clock
+}
+
+// test the breaker opens after the consecutive failures, and a probe after the cooldown closes it
+func TestBreaker(t *testing.T) {
+	b, clock := newTestBreaker(3, 10*time.Second)
+	down := topology.ServerSelectionError{Wrapped: errors.New("connection refused")}
+
+	// a success between the failures resets the count
+	for _, err := range []error{down, down, nil, down, down} {
+		assert.NoError(t, b.allow())
+		b.record(err)
+	}
+	assert.NoError(t, b.allow())
+	b.record(down)
+	assert.ErrorIs(t, b.allow(), errCircuitOpen)
+	assert.Equal(t, float64(breakerOpen), testutil.ToFloat64(metrics.MongoCircuitState))
+
+	// a single probe is let through after the cooldown, and its failure opens the breaker again
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, b.allow())
+	assert.ErrorIs(t, b.allow(), errCircuitOpen)
+	b.record(context.DeadlineExceeded)
+	assert.ErrorIs(t, b.allow(), errCircuitOpen)
+
+	// a probe canceled by its client lets the next one probe
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, b.allow())
+	b.record(context.Canceled)
+	assert.NoError(t, b.allow())
+
+	// an answer from mongodb, even an error one, closes it
+	b.record(errors.New("something is broken"))
+	assert.NoError(t, b.allow())
+	assert.NoError(t, b.allow())
+	assert.Equal(t, float64(breakerClosed), testutil.ToFloat64(metrics.MongoCircuitState))
+}
+
+// test a breaker without a threshold never opens
+func TestBreaker_Disabled(t *testing.T) {
+	b, _ := newTestBreaker(0, time.Second)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, b.allow())
+		b.record(context.DeadlineExceeded)
+	}
+	var nilBreaker *breaker
+	assert.NoError(t, nilBreaker.allow())
+	nilBreaker.record(context.DeadlineExceeded)
+}
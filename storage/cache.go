@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dcard/apperr"
+	"dcard/logging"
+	"dcard/metrics"
+	"dcard/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// define a store which can list every ad that has not ended, the cache loads its snapshot from it
+type SnapshotSource interface {
+	AdStore
+	// list the ads with endAt after now, including the ones which have not started yet
+	Snapshot(ctx context.Context, now time.Time) ([]File, error)
+}
+
+// define the cached backend of the ad store, the GET hot path is answered from an inverted index on an
+// in-memory snapshot of the ads which have not ended, while every other call goes to the backend
+type CachedStore struct {
+	backend SnapshotSource
+	clock   Clock
+	// answer from the last snapshot when it can not be reloaded because the backend is down
+	fallback bool
+
+	// the index on the snapshot sorted by endAt, it is replaced as a whole and never modified
+	mu    sync.RWMutex
+	index *adIndex
+
+	// a local write bumps the version, and the snapshot is stale until it is loaded at the new version
+	version   atomic.Uint64
+	loaded    uint64
+	refreshMu sync.Mutex
+
+	// the changes seen by the watcher wait here, so a burst of them is applied by one rebuild of the index
+	pendingMu sync.Mutex
+	pending   []Change
+	notify    chan struct{}
+
+	// the background goroutines stop when the cache is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ AdStore = (*CachedStore)(nil)
+
+// answer the queries from the last snapshot of the cache when it can not be reloaded because the backend is down,
+// instead of failing them
+func WithStaleFallback() Option {
+	return func(o *storeOptions) {
+		o.fallback = true
+	}
+}
+
+// establish a cache on the backend, load the first snapshot within the context and refresh it on the interval in background
+func NewCachedStore(ctx context.Context, backend SnapshotSource, interval time.Duration, opts ...Option) (*CachedStore, error) {
+	o := newStoreOptions(opts)
+	s := &CachedStore{backend: backend, clock: o.clock, fallback: o.fallback, notify: make(chan struct{}, 1)}
+	if err := s.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if interval > 0 {
+		s.wg.Add(1)
+		go s.refreshLoop(interval)
+	}
+	return s, nil
+}
+
+// reload the snapshot from the backend, a reload made by a query is traced in its request
+func (s *CachedStore) Refresh(ctx context.Context) error {
+	return s.refresh(ctx, false)
+}
+
+// reload the snapshot, onlyStale skips the load when another caller loaded the latest local write while this one waited
+func (s *CachedStore) refresh(ctx context.Context, onlyStale bool) (err error) {
+	ctx, span := tracing.Start(ctx, "refresh cache")
+	defer func() { tracing.End(span, err) }()
+
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	// read the version first, so a write finishing during the load leaves the snapshot stale
+	version := s.version.Load()
+	if onlyStale && s.loaded == version {
+		span.SetAttributes(attribute.Bool("cache.shared", true))
+		return nil
+	}
+	ads, err := s.backend.Snapshot(ctx, s.clock.Now())
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("ads.count", len(ads)))
+	sortByEndAt(ads)
+	index := newAdIndex(ads)
+
+	s.mu.Lock()
+	s.index = index
+	s.loaded = version
+	s.mu.Unlock()
+	return nil
+}
+
+// refresh the snapshot on the interval until the cache is closed, a failed refresh keeps the old snapshot
+func (s *CachedStore) refreshLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(s.ctx); err != nil {
+				slog.Warn("Fail to refresh the ad cache", "err", err)
+			}
+		}
+	}
+}
+
+// the time a change seen by the watcher waits for the changes after it, so a burst is applied by one rebuild
+const applyDelay = 50 * time.Millisecond
+
+// apply the changes seen by the watcher to the snapshot in background, until the cache is closed, it is called once
+func (s *CachedStore) Watch(watcher Watcher) {
+	s.wg.Add(2)
+	go s.applyLoop()
+	go func() {
+		defer s.wg.Done()
+		reload := func() {
+			// the snapshot loaded after the changes already has them
+			s.pendingMu.Lock()
+			s.pending = nil
+			s.pendingMu.Unlock()
+			if err := s.Refresh(s.ctx); err != nil {
+				slog.Warn("Fail to refresh the ad cache", "err", err)
+			}
+		}
+		if err := watcher.Watch(s.ctx, s.enqueue, reload); err != nil {
+			slog.Error("Stop watching the ads", "err", err)
+		}
+	}()
+}
+
+// queue a change seen by the watcher, it never blocks the watcher
+func (s *CachedStore) enqueue(change Change) {
+	s.pendingMu.Lock()
+	s.pending = append(s.pending, change)
+	s.pendingMu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// apply the queued changes, a change waits applyDelay for the rest of its burst, until the cache is closed
+func (s *CachedStore) applyLoop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.notify:
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(applyDelay):
+		}
+
+		s.pendingMu.Lock()
+		changes := s.pending
+		s.pending = nil
+		s.pendingMu.Unlock()
+		if len(changes) > 0 {
+			s.Apply(changes...)
+		}
+	}
+}
+
+// apply the changes of the ads to the snapshot without loading it again by one rebuild, an ended ad is removed
+// and the last change of an ad wins
+func (s *CachedStore) Apply(changes ...Change) {
+	_, span := tracing.Start(context.Background(), "apply changes", attribute.Int("changes.count", len(changes)))
+	defer span.End()
+
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	s.mu.RLock()
+	current := s.index.ads
+	s.mu.RUnlock()
+
+	last := make(map[string]Change, len(changes))
+	for _, change := range changes {
+		last[change.ID] = change
+	}
+	now := s.clock.Now()
+	upserts := make([]File, 0, len(last))
+	for id, change := range last {
+		if change.Op == ChangeUpsert && change.Ad.EndAt.After(now) {
+			ad := cloneFile(change.Ad)
+			ad.ID = id
+			upserts = append(upserts, ad)
+		}
+	}
+	sortByEndAt(upserts)
+
+	// the snapshot is shared by the running queries, so the changes are merged into a copy, which stays sorted
+	ads := make([]File, 0, len(current)+len(upserts))
+	for _, ad := range current {
+		if _, changed := last[ad.ID]; changed {
+			continue
+		}
+		for len(upserts) > 0 && endsBefore(upserts[0], ad) {
+			ads = append(ads, upserts[0])
+			upserts = upserts[1:]
+		}
+		ads = append(ads, ad)
+	}
+	ads = append(ads, upserts...)
+	index := newAdIndex(ads)
+
+	s.mu.Lock()
+	s.index = index
+	s.mu.Unlock()
+}
+
+// stop refreshing and watching the snapshot
+func (s *CachedStore) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// get the index on the snapshot, it is reloaded first when a local write made it stale, hit tells if it was fresh
+func (s *CachedStore) snapshot(ctx context.Context) (index *adIndex, hit bool, err error) {
+	s.mu.RLock()
+	index, fresh := s.index, s.loaded == s.version.Load()
+	s.mu.RUnlock()
+	if fresh {
+		return index, true, nil
+	}
+
+	// the queries waiting on the same stale snapshot share a single reload
+	if err := s.refresh(ctx, true); err != nil {
+		return nil, false, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index, false, nil
+}
+
+// check if the error tells the backend is down or too slow, a request canceled by its client is not answered at all
+func backendDown(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	kind := apperr.From(err).Kind
+	return kind == apperr.Unavailable || kind == apperr.Timeout
+}
+
+// mark the snapshot stale after a local write
+func (s *CachedStore) invalidate() {
+	s.version.Add(1)
+}
+
+// insert an ad into the backend
+func (s *CachedStore) Insert(ctx context.Context, ad File) (string, error) {
+	id, err := s.backend.Insert(ctx, ad)
+	if err == nil {
+		s.invalidate()
+	}
+	return id, err
+}
+
+// query the active ads from the inverted index on the snapshot with the same semantics as the backend
+func (s *CachedStore) Query(ctx context.Context, query QueryRequest) ([]File, error) {
+	index, hit, err := s.snapshot(ctx)
+	if err != nil && s.fallback && backendDown(err) {
+		// the ads may miss the latest writes, but they are still only the ones active now
+		logging.FromContext(ctx).Warn("Answer from the stale ad cache", "err", err)
+		metrics.CacheLookups.WithLabelValues("stale").Inc()
+		s.mu.RLock()
+		index, err = s.index, nil
+		s.mu.RUnlock()
+	} else if hit {
+		metrics.CacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		metrics.CacheLookups.WithLabelValues("miss").Inc()
+	}
+	if err != nil {
+		return []File{}, err
+	}
+
+	// the active window is checked now since scheduled ads are in the snapshot
+	_, span := tracing.Start(ctx, "query index", attribute.Bool("cache.hit", hit), attribute.Int("ads.count", len(index.ads)))
+	results, err := index.query(query, s.clock.Now())
+	tracing.End(span, err)
+	return results, err
+}
+
+// get the ad with the given id from the backend
+func (s *CachedStore) Get(ctx context.Context, id string) (File, error) {
+	return s.backend.Get(ctx, id)
+}
+
+// replace the ad with the given id in the backend
+func (s *CachedStore) Update(ctx context.Context, id string, ad File) error {
+	err := s.backend.Update(ctx, id, ad)
+	if err == nil {
+		s.invalidate()
+	}
+	return err
+}
+
+// change some fields of the ad with the given id in the backend
+func (s *CachedStore) Patch(ctx context.Context, id string, patch AdPatch) (File, error) {
+	ad, err := s.backend.Patch(ctx, id, patch)
+	if err == nil {
+		s.invalidate()
+	}
+	return ad, err
+}
+
+// delete the ad with the given id from the backend
+func (s *CachedStore) Delete(ctx context.Context, id string) error {
+	err := s.backend.Delete(ctx, id)
+	if err == nil {
+		s.invalidate()
+	}
+	return err
+}
+
+// get the usage of the quota from the backend
+func (s *CachedStore) Usage(ctx context.Context) (Usage, error) {
+	return s.backend.Usage(ctx)
+}
+
+// check the snapshot is loaded at the latest local write and the backend is reachable
+func (s *CachedStore) Ping(ctx context.Context) error {
+	if _, _, err := s.snapshot(ctx); err != nil {
+		return err
+	}
+	return s.backend.Ping(ctx)
+}
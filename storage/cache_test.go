@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dcard/apperr"
+	"dcard/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// define a snapshot source counting the calls on its backend, err is returned by the snapshot when set
+type countingSource struct {
+	*MemoryStore
+	snapshots atomic.Int64
+	queries   atomic.Int64
+	mu        sync.Mutex
+	err       error
+	// slow down the snapshot, so the queries waiting on a reload overlap
+	delay time.Duration
+}
+
+func (s *countingSource) Snapshot(ctx context.Context, now time.Time) ([]File, error) {
+	s.snapshots.Add(1)
+	s.mu.Lock()
+	err, delay := s.err, s.delay
+	s.mu.Unlock()
+	time.Sleep(delay)
+	if err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.Snapshot(ctx, now)
+}
+
+func (s *countingSource) Query(ctx context.Context, query QueryRequest) ([]File, error) {
+	s.queries.Add(1)
+	return s.MemoryStore.Query(ctx, query)
+}
+
+func (s *countingSource) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// establish a cache on a counting in-memory backend, and close it after the test
+func newTestCachedStore(t testing.TB, interval time.Duration, opts ...Option) (*CachedStore, *countingSource) {
+	source := &countingSource{MemoryStore: NewMemoryStore(opts...)}
+	cache, err := NewCachedStore(context.Background(), source, interval, opts...)
+	if err != nil {
+		t.Fatalf("Failed to establish the cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+	return cache, source
+}
+
+// test the cache answers the queries from its snapshot without the backend
+func TestCachedStore_Query(t *testing.T) {
+	cache, source := newTestCachedStore(t, 0)
+	for i := 0; i < 5; i++ {
+		_, err := cache.Insert(context.Background(), File{Title: "test AD" + strconv.Itoa(i), StartAt: time.Now(), EndAt: time.Now().Add(time.Duration(5-i) * time.Hour)})
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		results, err := cache.Query(context.Background(), QueryRequest{Offset: 1, Limit: 3})
+		assert.NoError(t, err)
+		if assert.Equal(t, 3, len(results)) {
+			assert.Equal(t, "test AD3", results[0].Title)
+			assert.Equal(t, "test AD1", results[2].Title)
+		}
+	}
+
+	// the first snapshot and a single reload after the inserts
+	assert.Equal(t, int64(2), source.snapshots.Load())
+	assert.Equal(t, int64(0), source.queries.Load())
+
+	// the offset is checked like the backend
+	_, err := cache.Query(context.Background(), QueryRequest{Offset: 6, Limit: 3})
+	assert.Equal(t, ErrOffsetOutOfRange, err)
+}
+
+// test the caller can not modify the snapshot
+func TestCachedStore_Copy(t *testing.T) {
+	cache, _ := newTestCachedStore(t, 0)
+	_, err := cache.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour), Conditions: []Condition{{Country: []string{"TW"}}}})
+	assert.NoError(t, err)
+
+	results, err := cache.Query(context.Background(), QueryRequest{Limit: 1})
+	assert.NoError(t, err)
+	results[0].Conditions[0].Country[0] = "JP"
+
+	results, err = cache.Query(context.Background(), QueryRequest{Limit: 1, Country: "TW"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+}
+
+// test the local writes are seen by the next query
+func TestCachedStore_Invalidate(t *testing.T) {
+	cache, _ := newTestCachedStore(t, time.Hour)
+	query := QueryRequest{Limit: 10}
+
+	id, err := cache.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	results, err := cache.Query(context.Background(), query)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	err = cache.Update(context.Background(), id, File{Title: "test AD updated", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	results, err = cache.Query(context.Background(), query)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(results)) {
+		assert.Equal(t, "test AD updated", results[0].Title)
+	}
+
+	title := "test AD patched"
+	_, err = cache.Patch(context.Background(), id, AdPatch{Title: &title})
+	assert.NoError(t, err)
+	results, err = cache.Query(context.Background(), query)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(results)) {
+		assert.Equal(t, title, results[0].Title)
+	}
+
+	assert.NoError(t, cache.Delete(context.Background(), id))
+	results, err = cache.Query(context.Background(), query)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+
+	// a failed write keeps the snapshot
+	assert.Equal(t, ErrNotFound, cache.Delete(context.Background(), id))
+}
+
+// test the writes of other servers are seen after the background refresh
+func TestCachedStore_Refresh(t *testing.T) {
+	cache, source := newTestCachedStore(t, 10*time.Millisecond)
+	query := QueryRequest{Limit: 10}
+
+	// write to the backend behind the cache
+	_, err := source.MemoryStore.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		results, err := cache.Query(context.Background(), query)
+		return err == nil && len(results) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+// test a failed refresh keeps the old snapshot, but a stale snapshot is never served
+func TestCachedStore_RefreshError(t *testing.T) {
+	cache, source := newTestCachedStore(t, 0)
+	_, err := cache.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	results, err := cache.Query(context.Background(), QueryRequest{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// the background refresh fails
+	source.setErr(errors.New("connection refused"))
+	assert.Error(t, cache.Refresh(context.Background()))
+	results, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// the snapshot is stale after a local write, so the error is returned
+	_, err = cache.Insert(context.Background(), File{Title: "test AD2", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	_, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+	assert.Error(t, err)
+
+	// it recovers with the backend
+	source.setErr(nil)
+	results, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+}
+
+// test the queries are counted as hits when answered by the loaded snapshot and as misses when it is reloaded
+func TestCachedStore_Lookups(t *testing.T) {
+	cache, _ := newTestCachedStore(t, 0)
+	hit, miss := metrics.CacheLookups.WithLabelValues("hit"), metrics.CacheLookups.WithLabelValues("miss")
+	hits, misses := testutil.ToFloat64(hit), testutil.ToFloat64(miss)
+
+	_, err := cache.Query(context.Background(), QueryRequest{Limit: 10})
+	assert.NoError(t, err)
+	_, err = cache.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	_, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+	assert.NoError(t, err)
+	_, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+	assert.NoError(t, err)
+
+	assert.Equal(t, hits+2, testutil.ToFloat64(hit))
+	assert.Equal(t, misses+1, testutil.ToFloat64(miss))
+}
+
+// test the reload made by a stale query is traced under the query
+func TestCachedStore_Trace(t *testing.T) {
+	cache, _ := newTestCachedStore(t, 0)
+	recorder := recordSpans(t)
+
+	_, err := cache.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	ctx, query := otel.Tracer("test").Start(context.Background(), "QueryData")
+	_, err = cache.Query(ctx, QueryRequest{Limit: 10})
+	assert.NoError(t, err)
+	query.End()
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	assert.Equal(t, "refresh cache", spans[0].Name())
+	assert.Contains(t, spans[0].Attributes(), attribute.Int("ads.count", 1))
+	assert.Equal(t, "query index", spans[1].Name())
+	assert.Contains(t, spans[1].Attributes(), attribute.Bool("cache.hit", false))
+	for _, span := range spans[:2] {
+		assert.Equal(t, query.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+}
+
+// test the cache is not ready while its snapshot can not be reloaded
+func TestCachedStore_Ping(t *testing.T) {
+	cache, source := newTestCachedStore(t, 0)
+	assert.NoError(t, cache.Ping(context.Background()))
+
+	// the loaded snapshot is still good
+	source.setErr(errors.New("connection refused"))
+	assert.NoError(t, cache.Ping(context.Background()))
+
+	// the snapshot is stale after a local write
+	_, err := cache.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Error(t, cache.Ping(context.Background()))
+
+	source.setErr(nil)
+	assert.NoError(t, cache.Ping(context.Background()))
+}
+
+// test the queries are answered from the last snapshot while the backend is down only with the stale fallback
+func TestCachedStore_StaleFallback(t *testing.T) {
+	unavailable := apperr.Wrap(apperr.Unavailable, "store_unavailable", "the ad store is unavailable", errors.New("connection refused"))
+	for _, fallback := range []bool{false, true} {
+		var opts []Option
+		if fallback {
+			opts = append(opts, WithStaleFallback())
+		}
+		cache, source := newTestCachedStore(t, 0, opts...)
+		_, err := cache.Insert(context.Background(), File{Title: "test AD0", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+		assert.NoError(t, err)
+		_, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+		assert.NoError(t, err)
+
+		// a write made before mongodb went down leaves the snapshot stale
+		_, err = cache.Insert(context.Background(), File{Title: "test AD1", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+		assert.NoError(t, err)
+		source.setErr(unavailable)
+		stale := metrics.CacheLookups.WithLabelValues("stale")
+		before := testutil.ToFloat64(stale)
+		results, err := cache.Query(context.Background(), QueryRequest{Limit: 10})
+		if !fallback {
+			assert.ErrorIs(t, err, unavailable)
+			continue
+		}
+		if assert.NoError(t, err) && assert.Len(t, results, 1) {
+			assert.Equal(t, "test AD0", results[0].Title)
+		}
+		assert.Equal(t, before+1, testutil.ToFloat64(stale))
+
+		// any other error still fails the query
+		source.setErr(errors.New("something is broken"))
+		_, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+		assert.Error(t, err)
+
+		// the latest writes are seen again once the backend is back
+		source.setErr(nil)
+		results, err = cache.Query(context.Background(), QueryRequest{Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, results, 2)
+	}
+}
+
+// test the cache fails to start when the first snapshot can not be loaded
+func TestNewCachedStore_Error(t *testing.T) {
+	source := &countingSource{MemoryStore: NewMemoryStore(), err: errors.New("connection refused")}
+	_, err := NewCachedStore(context.Background(), source, 0)
+	assert.Error(t, err)
+}
+
+// test the cache honors startAt without a refresh
+func TestCachedStore_Schedule(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	cache, _ := newTestCachedStore(t, 0, WithClock(clock))
+	runScheduleTest(t, cache, clock)
+}
+
+// test the cache serves the ads in their schedule without a refresh
+func TestCachedStore_Dayparting(t *testing.T) {
+	clock := newDaypartingClock()
+	cache, _ := newTestCachedStore(t, 0, WithClock(clock))
+	runDaypartingTest(t, cache, clock)
+}
+
+// test the concurrent queries after a local write share a single reload
+func TestCachedStore_SharedReload(t *testing.T) {
+	cache, source := newTestCachedStore(t, 0)
+	_, err := cache.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	source.mu.Lock()
+	source.delay = 20 * time.Millisecond
+	source.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, err := cache.Query(context.Background(), QueryRequest{Limit: 5})
+			assert.NoError(t, err)
+			assert.Len(t, results, 1)
+		}()
+	}
+	wg.Wait()
+
+	// the first snapshot and the one reload after the write
+	assert.Equal(t, int64(2), source.snapshots.Load())
+}
+
+// test the cache with the targeting matrix
+func TestCachedStore_Targeting(t *testing.T) {
+	cache, _ := newTestCachedStore(t, 0)
+	runTargetingMatrix(t, cache)
+}
+
+// test the cache under concurrent writes and queries
+func TestCachedStore_Concurrent(t *testing.T) {
+	cache, _ := newTestCachedStore(t, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := cache.Insert(context.Background(), File{Title: "test AD" + strconv.Itoa(i), StartAt: time.Now(), EndAt: time.Now().AddDate(0, 0, 1)})
+			assert.NoError(t, err)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := cache.Query(context.Background(), QueryRequest{Offset: 0, Limit: 100})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	results, err := cache.Query(context.Background(), QueryRequest{Offset: 0, Limit: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 50, len(results))
+}
+
+// seed 1000 active ads, the most the product contract allows
+func seedCacheBenchmark(b *testing.B, store AdStore) {
+	now := time.Now()
+	countries := []string{"TW", "JP", "US", "KR"}
+	platforms := []string{"android", "ios", "web"}
+	for i := 0; i < 1000; i++ {
+		_, err := store.Insert(context.Background(), File{
+			Title:   "bench AD" + strconv.Itoa(i),
+			StartAt: now.Add(-time.Hour),
+			EndAt:   now.Add(time.Duration(i+1) * time.Minute),
+			Conditions: []Condition{{
+				AgeStart: 20,
+				AgeEnd:   40,
+				Country:  []string{countries[i%len(countries)]},
+				Platform: []string{platforms[i%len(platforms)]},
+			}},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmark the query answered from the snapshot of the cache
+func BenchmarkQuery_Cached(b *testing.B) {
+	cache, _ := newTestCachedStore(b, 0)
+	seedCacheBenchmark(b, cache)
+	query := QueryRequest{Offset: 10, Limit: 10, Age: 30, Country: "TW", Platform: "ios"}
+	if _, err := cache.Query(context.Background(), query); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cache.Query(context.Background(), query); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmark the query of the in-memory store, which filters and sorts on every call
+func BenchmarkQuery_Memory(b *testing.B) {
+	store := NewMemoryStore()
+	seedCacheBenchmark(b, store)
+	query := QueryRequest{Offset: 10, Limit: 10, Age: 30, Country: "TW", Platform: "ios"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Query(context.Background(), query); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
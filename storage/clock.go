@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"time"
+)
+
+// define the source of the current time, so the active window can be tested without sleeping
+type Clock interface {
+	Now() time.Time
+}
+
+// the clock reading the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// set the optional settings of a store
+type Option func(*storeOptions)
+
+type storeOptions struct {
+	clock    Clock
+	quota    Quota
+	fallback bool
+}
+
+// use the given clock to decide which ads are active
+func WithClock(clock Clock) Option {
+	return func(o *storeOptions) {
+		o.clock = clock
+	}
+}
+
+// apply the options on top of the defaults
+func newStoreOptions(opts []Option) storeOptions {
+	o := storeOptions{clock: systemClock{}, quota: DefaultQuota}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
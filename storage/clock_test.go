@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// define a clock which only moves when the test advances it
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// run the scheduling test against a store using the fake clock
+func runScheduleTest(t *testing.T, store AdStore, clock *fakeClock) {
+	start := clock.Now().Add(time.Hour)
+
+	// a future ad is accepted
+	id, err := store.Insert(context.Background(), File{
+		Title:   "test AD scheduled",
+		StartAt: start,
+		EndAt:   start.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	_, err = store.Get(context.Background(), id)
+	assert.NoError(t, err)
+
+	query := QueryRequest{Offset: 0, Limit: 5}
+
+	// it is not served before its flight begins
+	results, err := store.Query(context.Background(), query)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+
+	// it becomes eligible exactly at startAt
+	clock.Advance(time.Hour)
+	results, err = store.Query(context.Background(), query)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(results)) {
+		assert.Equal(t, "test AD scheduled", results[0].Title)
+	}
+
+	// it is not served anymore at endAt
+	clock.Advance(time.Hour)
+	results, err = store.Query(context.Background(), query)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+}
+
+// test isactive on the bounds of the window
+func TestIsActive(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ad := File{StartAt: now, EndAt: now.Add(time.Hour)}
+
+	assert.False(t, isActive(ad, now.Add(-time.Nanosecond)))
+	assert.True(t, isActive(ad, now))
+	assert.True(t, isActive(ad, now.Add(time.Hour-time.Nanosecond)))
+	assert.False(t, isActive(ad, now.Add(time.Hour)))
+}
+
+// test the in-memory store honors startAt
+func TestMemoryStore_Schedule(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	runScheduleTest(t, NewMemoryStore(WithClock(clock)), clock)
+}
+
+// test the mongodb store honors startAt
+func TestMongoStore_Schedule(t *testing.T) {
+	clock := newFakeClock(time.Now().Truncate(time.Millisecond))
+	runScheduleTest(t, newTestMongoStore(t, WithClock(clock)), clock)
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"dcard/apperr"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// define the position of an ad in the endAt ordering, the next page starts after it
+type Cursor struct {
+	EndAt time.Time `json:"e"`
+	ID    string    `json:"i"`
+}
+
+// the error returned when a cursor token can not be decoded
+var ErrInvalidCursor = apperr.NewValidation("cursor", "invalid_cursor", "cursor is invalid")
+
+// set the cursor pointing at the given ad
+func CursorOf(ad File) Cursor {
+	return Cursor{EndAt: ad.EndAt, ID: ad.ID}
+}
+
+// encode the cursor into an opaque token
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decode the opaque token back into a cursor
+func DecodeCursor(token string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	if c.EndAt.IsZero() || !primitive.IsValidObjectID(c.ID) {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// check if the ad comes after the cursor in the endAt ordering
+func (c Cursor) before(ad File) bool {
+	if !ad.EndAt.Equal(c.EndAt) {
+		return ad.EndAt.After(c.EndAt)
+	}
+	return ad.ID > c.ID
+}
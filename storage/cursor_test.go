@@ -0,0 +1,91 @@
+package storage_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"dcard/storage"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// test a cursor can be decoded from its token
+func TestCursor_EncodeDecode(t *testing.T) {
+	cursor := storage.Cursor{
+		EndAt: time.Date(2024, 6, 21, 16, 0, 0, 123456789, time.UTC),
+		ID:    primitive.NewObjectID().Hex(),
+	}
+	decoded, err := storage.DecodeCursor(cursor.Encode())
+	assert.NoError(t, err)
+	assert.True(t, cursor.EndAt.Equal(decoded.EndAt))
+	assert.Equal(t, cursor.ID, decoded.ID)
+}
+
+// test invalid tokens are rejected
+func TestDecodeCursor_Invalid(t *testing.T) {
+	tokens := []string{
+		"not base64 !",
+		"bm90IGpzb24",
+		storage.Cursor{EndAt: time.Now(), ID: "not-an-object-id"}.Encode(),
+		storage.Cursor{ID: primitive.NewObjectID().Hex()}.Encode(),
+	}
+	for _, token := range tokens {
+		_, err := storage.DecodeCursor(token)
+		assert.Equal(t, storage.ErrInvalidCursor, err, token)
+	}
+}
+
+// test paging with a cursor returns every ad exactly once while new ads are posted
+func TestQueryData_Cursor(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	// insert ads, some of them share the same end time
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := storage.StoreData(context.Background(), store, storage.AdData{Ad: storage.File{
+			Title:   "test AD" + strconv.Itoa(i),
+			StartAt: now,
+			EndAt:   now.Add(time.Duration(i/2+1) * time.Hour),
+		}})
+		if err != nil {
+			t.Fatalf("Fail to store test ad: %v", err)
+		}
+	}
+
+	seen := make(map[string]int)
+	query := storage.QueryRequest{Limit: 3}
+	for page := 0; ; page++ {
+		results, err := storage.QueryData(context.Background(), store, query)
+		if err != nil {
+			t.Fatalf("Failed with query in cursor: %v", err)
+		}
+		for _, result := range results {
+			seen[result.Title]++
+		}
+		if len(results) < query.Limit {
+			break
+		}
+
+		// post an ad before the cursor while paging, it should not shift the next page
+		if page == 0 {
+			_, err := storage.StoreData(context.Background(), store, storage.AdData{Ad: storage.File{
+				Title:   "test AD early",
+				StartAt: now,
+				EndAt:   now.Add(time.Minute),
+			}})
+			if err != nil {
+				t.Fatalf("Fail to store test ad: %v", err)
+			}
+		}
+		after := storage.CursorOf(results[len(results)-1])
+		query.After = &after
+	}
+
+	assert.Equal(t, 10, len(seen))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, seen["test AD"+strconv.Itoa(i)])
+	}
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// the ages are indexed in buckets of 5 years, an age out of [0, maxIndexedAge] is only checked on the ads
+const (
+	ageBucketSize = 5
+	maxIndexedAge = 100
+)
+
+// define a set of positions in the sorted ads
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << (uint(i) % 64)
+}
+
+// copy the set, so the positions of another set can be added to it
+func (b bitset) clone() bitset {
+	return append(bitset{}, b...)
+}
+
+func (b bitset) or(other bitset) {
+	for i := range b {
+		b[i] |= other[i]
+	}
+}
+
+// define the postings of a list field, the wildcard is the ads which do not restrict the field
+type postings struct {
+	values   map[string]bitset
+	wildcard bitset
+}
+
+// get the ads allowed by the value, the posting of each value already has the wildcard in it
+func (p postings) lookup(value string) bitset {
+	if b, ok := p.values[value]; ok {
+		return b
+	}
+	return p.wildcard
+}
+
+// define the inverted index on a snapshot of the ads, which is sorted by endAt and never modified
+type adIndex struct {
+	ads      []File
+	gender   postings
+	country  postings
+	platform postings
+	age      []bitset
+}
+
+// build the index of the ads sorted by endAt
+func newAdIndex(ads []File) *adIndex {
+	x := &adIndex{ads: ads, age: make([]bitset, maxIndexedAge/ageBucketSize+1)}
+	for i := range x.age {
+		x.age[i] = newBitset(len(ads))
+	}
+	x.gender = buildPostings(ads, func(c Condition) []string { return c.Gender })
+	x.country = buildPostings(ads, func(c Condition) []string { return c.Country })
+	x.platform = buildPostings(ads, func(c Condition) []string { return c.Platform })
+
+	for i, ad := range ads {
+		// an ad without condition and a condition of age 0 and 0 are in every bucket, an open bound reaches the end of the buckets
+		if len(ad.Conditions) == 0 {
+			x.setAges(i, 0, maxIndexedAge)
+		}
+		for _, cond := range ad.Conditions {
+			switch {
+			case len(cond.Ages) > 0:
+				for _, r := range cond.Ages {
+					from, to := 0, maxIndexedAge
+					if r.Min != nil {
+						from = *r.Min
+					}
+					if r.Max != nil {
+						to = *r.Max
+					}
+					x.setAges(i, from, to)
+				}
+			case cond.AgeStart == 0 && cond.AgeEnd == 0:
+				x.setAges(i, 0, maxIndexedAge)
+			default:
+				x.setAges(i, cond.AgeStart, cond.AgeEnd)
+			}
+		}
+	}
+	return x
+}
+
+// put the ad into the buckets overlapping [from, to]
+func (x *adIndex) setAges(i, from, to int) {
+	from, to = max(from, 0), min(to, maxIndexedAge)
+	for bucket := from / ageBucketSize; from <= to && bucket <= to/ageBucketSize; bucket++ {
+		x.age[bucket].set(i)
+	}
+}
+
+// build the postings of a list field, an ad is in the posting of a value when one of its conditions allows it
+func buildPostings(ads []File, list func(Condition) []string) postings {
+	p := postings{values: make(map[string]bitset), wildcard: newBitset(len(ads))}
+	for i, ad := range ads {
+		if len(ad.Conditions) == 0 {
+			p.wildcard.set(i)
+		}
+		for _, cond := range ad.Conditions {
+			values := list(cond)
+			if len(values) == 0 {
+				p.wildcard.set(i)
+			}
+			for _, value := range values {
+				if _, ok := p.values[value]; !ok {
+					p.values[value] = newBitset(len(ads))
+				}
+				p.values[value].set(i)
+			}
+		}
+	}
+	for value, b := range p.values {
+		merged := b.clone()
+		merged.or(p.wildcard)
+		p.values[value] = merged
+	}
+	return p
+}
+
+// query the active ads matching the requirement with the same semantics as the stores
+func (x *adIndex) query(query QueryRequest, now time.Time) ([]File, error) {
+	// intersect the postings of the supplied dimensions
+	lists := make([]bitset, 0, 4)
+	if query.Gender != "" {
+		lists = append(lists, x.gender.lookup(query.Gender))
+	}
+	if query.Country != "" {
+		lists = append(lists, x.country.lookup(query.Country))
+	}
+	if query.Platform != "" {
+		lists = append(lists, x.platform.lookup(query.Platform))
+	}
+	if query.Age > 0 && query.Age <= maxIndexedAge {
+		lists = append(lists, x.age[query.Age/ageBucketSize])
+	}
+
+	// the ads are sorted, so the page after the cursor starts right after its position
+	start := 0
+	if query.After != nil {
+		start = sort.Search(len(x.ads), func(i int) bool { return query.After.before(x.ads[i]) })
+	}
+
+	// the postings only tell one of the conditions allows each dimension and ignore the exclude lists, so the candidates are checked on the ads
+	skipped := 0
+	results := make([]File, 0, query.Limit)
+	for i := x.next(lists, start); i >= 0; i = x.next(lists, i+1) {
+		if skipped == query.Offset && len(results) >= query.Limit {
+			break
+		}
+		ad := x.ads[i]
+		if !isActive(ad, now) || !inSchedule(ad, now) || !matchAd(ad, query) {
+			continue
+		}
+		if skipped < query.Offset {
+			skipped++
+			continue
+		}
+		results = append(results, cloneFile(ad))
+	}
+	if skipped < query.Offset {
+		return []File{}, ErrOffsetOutOfRange
+	}
+	return results, nil
+}
+
+// find the first position from i which is in every list, -1 when there is none
+func (x *adIndex) next(lists []bitset, i int) int {
+	if i >= len(x.ads) {
+		return -1
+	}
+	if len(lists) == 0 {
+		return i
+	}
+	for w := i / 64; w < len(lists[0]); w++ {
+		word := ^uint64(0)
+		for _, list := range lists {
+			word &= list[w]
+		}
+		// ignore the positions before i in its word
+		if w == i/64 {
+			word &= ^uint64(0) << (uint(i) % 64)
+		}
+		if word != 0 {
+			return w*64 + bits.TrailingZeros64(word)
+		}
+	}
+	return -1
+}
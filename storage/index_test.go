@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// query the sorted ads with a linear filter, the index should always return the same page
+func linearQuery(ads []File, query QueryRequest, now time.Time) ([]File, error) {
+	results := make([]File, 0)
+	for _, ad := range ads {
+		if query.After != nil && !query.After.before(ad) {
+			continue
+		}
+		if isActive(ad, now) && matchAd(ad, query) {
+			results = append(results, ad)
+		}
+	}
+	return paginate(results, query.Offset, query.Limit)
+}
+
+// generate random ads sorted by endAt, a small domain of values makes the conditions collide
+func randomAds(r *rand.Rand, n int, now time.Time) []File {
+	genders := []string{"M", "F"}
+	countries := []string{"TW", "JP", "US", "KR", "HK"}
+	platforms := []string{"android", "ios", "web"}
+	pick := func(values []string) []string {
+		list := make([]string, 0)
+		for _, v := range values {
+			if r.Intn(3) == 0 {
+				list = append(list, v)
+			}
+		}
+		return list
+	}
+
+	ads := make([]File, n)
+	for i := range ads {
+		conditions := make([]Condition, r.Intn(3))
+		for j := range conditions {
+			conditions[j] = Condition{Gender: pick(genders), Country: pick(countries), Platform: pick(platforms)}
+			if r.Intn(4) != 0 {
+				conditions[j].AgeStart = 1 + r.Intn(100)
+				conditions[j].AgeEnd = conditions[j].AgeStart + r.Intn(30)
+			}
+		}
+		ads[i] = File{
+			ID:         primitive.NewObjectID().Hex(),
+			Title:      "test AD" + strconv.Itoa(i),
+			StartAt:    now.Add(time.Duration(r.Intn(120)-100) * time.Minute),
+			EndAt:      now.Add(time.Duration(r.Intn(1000)+1) * time.Minute),
+			Conditions: conditions,
+		}
+	}
+	sortByEndAt(ads)
+	return ads
+}
+
+// generate a random query, including the ages out of the indexed range
+func randomQuery(r *rand.Rand, ads []File) QueryRequest {
+	query := QueryRequest{Offset: r.Intn(5), Limit: 1 + r.Intn(20)}
+	if r.Intn(2) == 0 {
+		query.Age = r.Intn(130) - 10
+	}
+	if r.Intn(2) == 0 {
+		query.Gender = []string{"M", "F", "X"}[r.Intn(3)]
+	}
+	if r.Intn(2) == 0 {
+		query.Country = []string{"TW", "JP", "US", "KR", "HK", "FR"}[r.Intn(6)]
+	}
+	if r.Intn(2) == 0 {
+		query.Platform = []string{"android", "ios", "web"}[r.Intn(3)]
+	}
+	if r.Intn(3) == 0 && len(ads) > 0 {
+		after := CursorOf(ads[r.Intn(len(ads))])
+		query.After = &after
+		query.Offset = 0
+	}
+	return query
+}
+
+// test the index returns the same page as the linear filter
+func TestAdIndex_SameAsLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	now := time.Now()
+	for _, n := range []int{0, 1, 63, 64, 65, 500} {
+		ads := randomAds(r, n, now)
+		index := newAdIndex(ads)
+		for i := 0; i < 500; i++ {
+			query := randomQuery(r, ads)
+			want, wantErr := linearQuery(ads, query, now)
+			got, err := index.query(query, now)
+			assert.Equal(t, wantErr, err, "n=%d query=%+v", n, query)
+			assert.Equal(t, want, got, "n=%d query=%+v", n, query)
+		}
+	}
+}
+
+// test the index with the targeting matrix
+func TestAdIndex_Targeting(t *testing.T) {
+	ads := targetingAds()
+	for i := range ads {
+		ads[i].ID = primitive.NewObjectID().Hex()
+	}
+	sortByEndAt(ads)
+	index := newAdIndex(ads)
+
+	for _, tc := range targetingMatrix {
+		t.Run(tc.name, func(t *testing.T) {
+			query := tc.query
+			query.Limit = 100
+			results, err := index.query(query, time.Now())
+			assert.NoError(t, err)
+			titles := make([]string, len(results))
+			for i, result := range results {
+				titles[i] = result.Title
+			}
+			assert.ElementsMatch(t, tc.want, titles)
+		})
+	}
+}
+
+// test the postings of a value have the wildcard ads in them
+func TestBuildPostings(t *testing.T) {
+	ads := []File{
+		{Conditions: []Condition{{Country: []string{"TW"}}}},
+		{},
+		{Conditions: []Condition{{Country: []string{"JP"}}, {Country: []string{}}}},
+		{Conditions: []Condition{{Country: []string{"JP"}}}},
+	}
+	p := buildPostings(ads, func(c Condition) []string { return c.Country })
+	assert.Equal(t, bitset{0b0111}, p.lookup("TW"))
+	assert.Equal(t, bitset{0b1110}, p.lookup("JP"))
+	assert.Equal(t, bitset{0b0110}, p.lookup("US"))
+}
+
+// test next finds the positions in every list across the words
+func TestAdIndex_Next(t *testing.T) {
+	x := &adIndex{ads: make([]File, 200)}
+	a, b := newBitset(200), newBitset(200)
+	for _, i := range []int{3, 64, 100, 130, 199} {
+		a.set(i)
+	}
+	for _, i := range []int{64, 99, 130, 199} {
+		b.set(i)
+	}
+
+	assert.Equal(t, 0, x.next(nil, 0))
+	assert.Equal(t, -1, x.next(nil, 200))
+	assert.Equal(t, 3, x.next([]bitset{a}, 0))
+	assert.Equal(t, 64, x.next([]bitset{a, b}, 0))
+	assert.Equal(t, 130, x.next([]bitset{a, b}, 65))
+	assert.Equal(t, 199, x.next([]bitset{a, b}, 131))
+	assert.Equal(t, -1, x.next([]bitset{a, b}, 200))
+}
+
+// benchmark the query on the index and on the linear filter at 1k, 10k and 100k ads, with concurrent clients
+func BenchmarkAdIndex(b *testing.B) {
+	now := time.Now()
+	for _, n := range []int{1000, 10000, 100000} {
+		r := rand.New(rand.NewSource(1))
+		ads := randomAds(r, n, now)
+		index := newAdIndex(ads)
+		queries := make([]QueryRequest, 1024)
+		for i := range queries {
+			queries[i] = randomQuery(r, nil)
+		}
+
+		b.Run(strconv.Itoa(n/1000)+"k/index", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := index.query(queries[i%len(queries)], now); err != nil && err != ErrOffsetOutOfRange {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "qps")
+		})
+		b.Run(strconv.Itoa(n/1000)+"k/linear", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := linearQuery(ads, queries[i%len(queries)], now); err != nil && err != ErrOffsetOutOfRange {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "qps")
+		})
+	}
+}
+
+// benchmark building the index, which is done on every reload of the snapshot
+func BenchmarkNewAdIndex(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		ads := randomAds(rand.New(rand.NewSource(1)), n, time.Now())
+		b.Run(strconv.Itoa(n/1000)+"k", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				newAdIndex(ads)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+	// the time zones of the schedules do not depend on the zoneinfo of the host
+	_ "time/tzdata"
+)
+
+// check if the ad is active at the given time, which means startAt <= now < endAt
+func isActive(ad File, now time.Time) bool {
+	return !ad.StartAt.After(now) && ad.EndAt.After(now)
+}
+
+// the days of week of a schedule in the order of time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// the time zones loaded by the schedules, each zone is only loaded once
+var timeZones sync.Map
+
+// load the iana time zone of a schedule from the cache
+func loadTimeZone(name string) (*time.Location, error) {
+	if loc, ok := timeZones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	timeZones.Store(name, loc)
+	return loc, nil
+}
+
+// check if the schedule of the ad serves it at the given time, an ad without schedule is served all the time
+func inSchedule(ad File, now time.Time) bool {
+	if ad.Schedule == nil {
+		return true
+	}
+	// the time zone is validated when the ad is written, a zone which can not be loaded is never served
+	loc, err := loadTimeZone(ad.Schedule.TimeZone)
+	if err != nil {
+		return false
+	}
+	local := now.In(loc)
+	if !matchList(ad.Schedule.Days, weekdays[local.Weekday()]) {
+		return false
+	}
+	if len(ad.Schedule.Hours) == 0 {
+		return true
+	}
+	for _, r := range ad.Schedule.Hours {
+		if local.Hour() >= r.Start && local.Hour() < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the ad is targeted by the query, an ad matches when one of its conditions matches
+func matchAd(ad File, query QueryRequest) bool {
+	// an ad without condition is not restricted at all
+	if len(ad.Conditions) == 0 {
+		return true
+	}
+	for _, cond := range ad.Conditions {
+		if matchCondition(cond, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if a single condition satisfies every supplied dimension of the query
+func matchCondition(cond Condition, query QueryRequest) bool {
+	if query.Age != 0 && !matchAge(cond, query.Age) {
+		return false
+	}
+	return matchList(cond.Gender, query.Gender) && !excludeList(cond.ExcludeGender, query.Gender) &&
+		matchList(cond.Country, query.Country) && !excludeList(cond.ExcludeCountry, query.Country) &&
+		matchList(cond.Platform, query.Platform) && !excludeList(cond.ExcludePlatform, query.Platform)
+}
+
+// check if the age is in one of the age ranges, a condition without ages falls back on the legacy age range
+func matchAge(cond Condition, age int) bool {
+	if len(cond.Ages) == 0 {
+		return (cond.AgeStart == 0 && cond.AgeEnd == 0) || (age >= cond.AgeStart && age <= cond.AgeEnd)
+	}
+	for _, r := range cond.Ages {
+		if r.contains(age) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the age is in the range, a nil bound is open
+func (r AgeRange) contains(age int) bool {
+	return (r.Min == nil || age >= *r.Min) && (r.Max == nil || age <= *r.Max)
+}
+
+// check if the value is allowed by the list, an unset value or an empty list is a wildcard
+func matchList(list []string, value string) bool {
+	if value == "" || len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the value is excluded by the list, an unset value is never excluded
+func excludeList(list []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sort the ads by end time, the id breaks the tie so the order is stable
+func sortByEndAt(ads []File) {
+	sort.Slice(ads, func(i, j int) bool { return endsBefore(ads[i], ads[j]) })
+}
+
+// check if the ad comes before the other one in the endAt ordering
+func endsBefore(ad, other File) bool {
+	if !ad.EndAt.Equal(other.EndAt) {
+		return ad.EndAt.Before(other.EndAt)
+	}
+	return ad.ID < other.ID
+}
+
+// apply offset and limit on the sorted results
+func paginate(results []File, offset, limit int) ([]File, error) {
+	if offset > len(results) {
+		return []File{}, ErrOffsetOutOfRange
+	}
+	if offset+limit > len(results) {
+		return results[offset:], nil
+	}
+	return results[offset : offset+limit], nil
+}
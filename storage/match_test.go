@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// get a pointer to the age, so a bound of an age range can be set in a literal
+func age(n int) *int {
+	return &n
+}
+
+// the ads shared by the targeting test matrix
+func targetingAds() []File {
+	endAt := time.Now().AddDate(0, 0, 1)
+	return []File{
+		{Title: "no condition", EndAt: endAt},
+		{Title: "wildcard", EndAt: endAt, Conditions: []Condition{
+			{AgeStart: 0, AgeEnd: 0, Gender: nil, Country: nil, Platform: nil},
+		}},
+		{Title: "empty lists", EndAt: endAt, Conditions: []Condition{
+			{AgeStart: 0, AgeEnd: 0, Gender: []string{}, Country: []string{}, Platform: []string{}},
+		}},
+		{Title: "young women in TW JP on ios", EndAt: endAt, Conditions: []Condition{
+			{AgeStart: 20, AgeEnd: 30, Gender: []string{"F"}, Country: []string{"TW", "JP"}, Platform: []string{"ios"}},
+		}},
+		{Title: "men in TW or women in JP", EndAt: endAt, Conditions: []Condition{
+			{Gender: []string{"M"}, Country: []string{"TW"}},
+			{Gender: []string{"F"}, Country: []string{"JP"}},
+		}},
+		{Title: "over 40 on web", EndAt: endAt, Conditions: []Condition{
+			{AgeStart: 40, AgeEnd: 50, Platform: []string{"web"}},
+		}},
+		{Title: "everywhere except CN", EndAt: endAt, Conditions: []Condition{
+			{ExcludeCountry: []string{"CN"}},
+		}},
+		{Title: "women except on android", EndAt: endAt, Conditions: []Condition{
+			{Gender: []string{"F"}, ExcludePlatform: []string{"android"}},
+		}},
+		{Title: "TW except men", EndAt: endAt, Conditions: []Condition{
+			{Country: []string{"TW"}, ExcludeGender: []string{"M"}},
+		}},
+		{Title: "18 and over", EndAt: endAt, Conditions: []Condition{
+			{Ages: []AgeRange{{Min: age(18)}}},
+		}},
+		{Title: "under 25 or over 60", EndAt: endAt, Conditions: []Condition{
+			{Ages: []AgeRange{{Max: age(24)}, {Min: age(60)}}},
+		}},
+	}
+}
+
+// the query dimensions and the titles of the ads expected to match
+var targetingMatrix = []struct {
+	name  string
+	query QueryRequest
+	want  []string
+}{
+	{
+		name:  "no dimension",
+		query: QueryRequest{},
+		want:  []string{"no condition", "wildcard", "empty lists", "young women in TW JP on ios", "men in TW or women in JP", "over 40 on web", "everywhere except CN", "women except on android", "TW except men", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "age only",
+		query: QueryRequest{Age: 25},
+		want:  []string{"no condition", "wildcard", "empty lists", "young women in TW JP on ios", "men in TW or women in JP", "everywhere except CN", "women except on android", "TW except men", "18 and over"},
+	},
+	{
+		name:  "age on the bounds",
+		query: QueryRequest{Age: 40},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "over 40 on web", "everywhere except CN", "women except on android", "TW except men", "18 and over"},
+	},
+	{
+		name:  "gender only",
+		query: QueryRequest{Gender: "M"},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "over 40 on web", "everywhere except CN", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "country only",
+		query: QueryRequest{Country: "JP"},
+		want:  []string{"no condition", "wildcard", "empty lists", "young women in TW JP on ios", "men in TW or women in JP", "over 40 on web", "everywhere except CN", "women except on android", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "platform only",
+		query: QueryRequest{Platform: "android"},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "everywhere except CN", "TW except men", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "age and gender",
+		query: QueryRequest{Age: 25, Gender: "F"},
+		want:  []string{"no condition", "wildcard", "empty lists", "young women in TW JP on ios", "men in TW or women in JP", "everywhere except CN", "women except on android", "TW except men", "18 and over"},
+	},
+	{
+		name:  "age and platform from different ads",
+		query: QueryRequest{Age: 45, Platform: "ios"},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "everywhere except CN", "women except on android", "TW except men", "18 and over"},
+	},
+	{
+		name:  "gender and country within one condition",
+		query: QueryRequest{Gender: "F", Country: "JP"},
+		want:  []string{"no condition", "wildcard", "empty lists", "young women in TW JP on ios", "men in TW or women in JP", "over 40 on web", "everywhere except CN", "women except on android", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "gender and country across conditions",
+		query: QueryRequest{Gender: "M", Country: "JP"},
+		want:  []string{"no condition", "wildcard", "empty lists", "over 40 on web", "everywhere except CN", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "all dimensions",
+		query: QueryRequest{Age: 25, Gender: "F", Country: "TW", Platform: "ios"},
+		want:  []string{"no condition", "wildcard", "empty lists", "young women in TW JP on ios", "everywhere except CN", "women except on android", "TW except men", "18 and over"},
+	},
+	{
+		name:  "all dimensions with one mismatch",
+		query: QueryRequest{Age: 35, Gender: "F", Country: "TW", Platform: "ios"},
+		want:  []string{"no condition", "wildcard", "empty lists", "everywhere except CN", "women except on android", "TW except men", "18 and over"},
+	},
+	{
+		name:  "excluded country",
+		query: QueryRequest{Country: "CN"},
+		want:  []string{"no condition", "wildcard", "empty lists", "over 40 on web", "women except on android", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "excluded platform",
+		query: QueryRequest{Gender: "F", Platform: "android"},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "everywhere except CN", "TW except men", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "excluded gender",
+		query: QueryRequest{Gender: "M", Country: "TW"},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "over 40 on web", "everywhere except CN", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "under the upper bound",
+		query: QueryRequest{Age: 18},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "everywhere except CN", "women except on android", "TW except men", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "between the age ranges",
+		query: QueryRequest{Age: 30},
+		want:  []string{"no condition", "wildcard", "empty lists", "young women in TW JP on ios", "men in TW or women in JP", "everywhere except CN", "women except on android", "TW except men", "18 and over"},
+	},
+	{
+		name:  "over the lower bound",
+		query: QueryRequest{Age: 70},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "everywhere except CN", "women except on android", "TW except men", "18 and over", "under 25 or over 60"},
+	},
+	{
+		name:  "below the open range",
+		query: QueryRequest{Age: 17},
+		want:  []string{"no condition", "wildcard", "empty lists", "men in TW or women in JP", "everywhere except CN", "women except on android", "TW except men", "under 25 or over 60"},
+	},
+}
+
+// run the targeting matrix against the query function of a store
+func runTargetingMatrix(t *testing.T, store AdStore) {
+	for _, ad := range targetingAds() {
+		if _, err := store.Insert(context.Background(), ad); err != nil {
+			t.Fatalf("Fail to store test ad: %v", err)
+		}
+	}
+	for _, tc := range targetingMatrix {
+		t.Run(tc.name, func(t *testing.T) {
+			query := tc.query
+			query.Limit = 100
+			results, err := store.Query(context.Background(), query)
+			if err != nil {
+				t.Fatalf("Failed with query: %v", err)
+			}
+			titles := make([]string, len(results))
+			for i, result := range results {
+				titles[i] = result.Title
+			}
+			assert.ElementsMatch(t, tc.want, titles)
+		})
+	}
+}
+
+// test matchad with the targeting matrix
+func TestMatchAd(t *testing.T) {
+	for _, tc := range targetingMatrix {
+		t.Run(tc.name, func(t *testing.T) {
+			titles := make([]string, 0)
+			for _, ad := range targetingAds() {
+				if matchAd(ad, tc.query) {
+					titles = append(titles, ad.Title)
+				}
+			}
+			assert.ElementsMatch(t, tc.want, titles)
+		})
+	}
+}
+
+// test the in-memory store with the targeting matrix
+func TestMemoryStore_Targeting(t *testing.T) {
+	runTargetingMatrix(t, NewMemoryStore())
+}
+
+// test the mongodb store with the targeting matrix
+func TestMongoStore_Targeting(t *testing.T) {
+	runTargetingMatrix(t, newTestMongoStore(t))
+}
+
+// test the filter applies every supplied dimension inside one $elemMatch
+func TestConditionFilter(t *testing.T) {
+	// no dimension means no condition filter
+	assert.Nil(t, conditionFilter(QueryRequest{}))
+	_, ok := queryFilter(QueryRequest{}, time.Now(), nil)["$or"]
+	assert.False(t, ok)
+
+	// every dimension is kept
+	match := conditionFilter(QueryRequest{Age: 25, Gender: "F", Country: "TW", Platform: "ios"})
+	clauses := match["$and"]
+	assert.Len(t, clauses, 4)
+
+	fields := make([]string, 0)
+	for _, clause := range clauses.([]bson.M)[1:] {
+		for _, or := range clause["$or"].([]bson.M) {
+			for field := range or {
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	assert.Equal(t, []string{"country", "country", "country", "gender", "gender", "gender", "platform", "platform", "platform"}, fields)
+
+	// the age is checked on the age ranges, and on the legacy age range only when there is none
+	ages := clauses.([]bson.M)[0]["$or"].([]bson.M)
+	assert.Contains(t, ages[0], "ages")
+	assert.Contains(t, ages[1], "ages")
+	assert.Len(t, ages[1]["$or"], 2)
+
+	// the value is also checked against the exclude list of the same condition
+	for i, exclude := range []string{"excludegender", "excludecountry", "excludeplatform"} {
+		assert.Contains(t, clauses.([]bson.M)[i+1], exclude)
+	}
+}
+
+// the schedule of the dayparting tests, 18:00 to 23:00 in taipei on weekdays
+func eveningSchedule() *Schedule {
+	return &Schedule{
+		TimeZone: "Asia/Taipei",
+		Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+		Hours:    []HourRange{{Start: 18, End: 23}},
+	}
+}
+
+// test inschedule computes the day and the hour in the time zone of the ad
+func TestInSchedule(t *testing.T) {
+	// friday 2024-06-21 in taipei, which is 8 hours ahead of utc
+	friday := func(hour, minute int) time.Time { return time.Date(2024, 6, 21, hour-8, minute, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		now      time.Time
+		want     bool
+	}{
+		{"no schedule", nil, friday(3, 0), true},
+		{"before the hours", eveningSchedule(), friday(17, 59), false},
+		{"start of the hours", eveningSchedule(), friday(18, 0), true},
+		{"last minute of the hours", eveningSchedule(), friday(22, 59), true},
+		{"end of the hours", eveningSchedule(), friday(23, 0), false},
+		{"weekend in taipei while friday in utc", eveningSchedule(), time.Date(2024, 6, 21, 16, 30, 0, 0, time.UTC), false},
+		{"weekend", eveningSchedule(), friday(18, 0).AddDate(0, 0, 1), false},
+		{"every day and all day", &Schedule{TimeZone: "Asia/Taipei"}, friday(3, 0), true},
+		{"several hour ranges", &Schedule{TimeZone: "Asia/Taipei", Hours: []HourRange{{Start: 7, End: 9}, {Start: 18, End: 23}}}, friday(8, 30), true},
+		{"other time zone", &Schedule{TimeZone: "America/New_York", Hours: []HourRange{{Start: 18, End: 23}}}, friday(18, 0), false},
+		{"unknown time zone", &Schedule{TimeZone: "Mars/Olympus"}, friday(18, 0), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, inSchedule(File{Schedule: test.schedule}, test.now))
+		})
+	}
+}
+
+// run the dayparting test against a store using the fake clock, which starts at 17:00 on a friday in taipei
+func runDaypartingTest(t *testing.T, store AdStore, clock *fakeClock) {
+	for _, ad := range []File{
+		{Title: "evenings on weekdays", Schedule: eveningSchedule()},
+		{Title: "all the time"},
+	} {
+		ad.StartAt = clock.Now().Add(-time.Hour)
+		ad.EndAt = clock.Now().AddDate(0, 0, 30)
+		if _, err := store.Insert(context.Background(), ad); err != nil {
+			t.Fatalf("Fail to store test ad: %v", err)
+		}
+	}
+
+	steps := []struct {
+		advance time.Duration
+		want    []string
+	}{
+		{0, []string{"all the time"}},
+		{time.Hour, []string{"evenings on weekdays", "all the time"}},
+		{5 * time.Hour, []string{"all the time"}},
+		// saturday 18:00 and monday 18:00
+		{19 * time.Hour, []string{"all the time"}},
+		{48 * time.Hour, []string{"evenings on weekdays", "all the time"}},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		results, err := store.Query(context.Background(), QueryRequest{Limit: 5})
+		if err != nil {
+			t.Fatalf("Failed with query: %v", err)
+		}
+		titles := make([]string, len(results))
+		for i, result := range results {
+			titles[i] = result.Title
+		}
+		assert.ElementsMatch(t, step.want, titles, clock.Now().String())
+	}
+}
+
+// the fake clock of the dayparting tests
+func newDaypartingClock() *fakeClock {
+	return newFakeClock(time.Date(2024, 6, 21, 9, 0, 0, 0, time.UTC))
+}
+
+// test the in-memory store serves the ads in their schedule
+func TestMemoryStore_Dayparting(t *testing.T) {
+	clock := newDaypartingClock()
+	runDaypartingTest(t, NewMemoryStore(WithClock(clock)), clock)
+}
+
+// test the mongodb store serves the ads in their schedule
+func TestMongoStore_Dayparting(t *testing.T) {
+	clock := newDaypartingClock()
+	runDaypartingTest(t, newTestMongoStore(t, WithClock(clock)), clock)
+}
+
+// test the schedule filter is applied beside the condition filter
+func TestScheduleFilter(t *testing.T) {
+	filter := queryFilter(QueryRequest{Gender: "F"}, time.Now(), nil)
+	and, ok := filter["$and"].([]bson.M)
+	if assert.True(t, ok) && assert.Len(t, and, 1) {
+		or := and[0]["$or"].([]bson.M)
+		assert.Equal(t, []bson.M{{"schedule": nil}}, or)
+	}
+	assert.Contains(t, filter, "$or")
+}
+
+// test the day and the hour are computed in go for each time zone, without any mongodb time zone
+func TestScheduleFilter_TimeZones(t *testing.T) {
+	// friday 17:00 utc is saturday 01:00 in taipei and shanghai, and friday 10:00 in los angeles
+	now := time.Date(2024, 6, 21, 17, 0, 0, 0, time.UTC)
+	filter := scheduleFilter(now, []string{"Asia/Taipei", "America/Los_Angeles", "Asia/Shanghai", "Mars/Olympus"})
+
+	or := filter["$or"].([]bson.M)
+	if !assert.Len(t, or, 3) {
+		return
+	}
+	assert.Equal(t, bson.M{"schedule": nil}, or[0])
+
+	// the zones at the same day and hour share a clause, and an unknown zone is left out
+	got := make(map[string][]string)
+	for _, clause := range or[1:] {
+		zones := clause["schedule.timezone"].(bson.M)["$in"].([]string)
+		and := clause["$and"].([]bson.M)
+		day := and[0]["$or"].([]bson.M)[2]["schedule.days"].(string)
+		hour := and[1]["$or"].([]bson.M)[2]["schedule.hours"].(bson.M)["$elemMatch"].(bson.M)["start"].(bson.M)["$lte"].(int)
+		got[fmt.Sprintf("%s %d", day, hour)] = zones
+		assert.NotContains(t, fmt.Sprint(clause), "$expr")
+	}
+	assert.Equal(t, map[string][]string{
+		"sat 1":  {"Asia/Taipei", "Asia/Shanghai"},
+		"fri 10": {"America/Los_Angeles"},
+	}, got)
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"dcard/tracing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// define the in-memory backend of the ad store, it is safe for concurrent use
+type MemoryStore struct {
+	mu      sync.RWMutex
+	ads     map[string]File
+	created map[string]int
+	clock   Clock
+	quota   Quota
+}
+
+var _ SnapshotSource = (*MemoryStore)(nil)
+
+// establish a new empty in-memory store
+func NewMemoryStore(opts ...Option) *MemoryStore {
+	o := newStoreOptions(opts)
+	return &MemoryStore{ads: make(map[string]File), created: make(map[string]int), clock: o.clock, quota: o.quota}
+}
+
+// insert an ad into memory and return its generated id, the quota is checked under the same lock
+func (s *MemoryStore) Insert(_ context.Context, ad File) (string, error) {
+	ad = cloneFile(ad)
+	ad.ID = primitive.NewObjectID().Hex()
+	day := quotaDay(s.clock.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quota.DailyLimit > 0 && s.created[day] >= s.quota.DailyLimit {
+		return "", errDailyQuotaExceeded(s.quota.DailyLimit, s.created[day])
+	}
+	if err := s.checkActiveCap(ad); err != nil {
+		return "", err
+	}
+	s.created[day]++
+	s.ads[ad.ID] = ad
+	return ad.ID, nil
+}
+
+// query the active ads with the same semantics as the mongodb store
+func (s *MemoryStore) Query(ctx context.Context, query QueryRequest) ([]File, error) {
+	now := s.clock.Now()
+
+	s.mu.RLock()
+	results := make([]File, 0)
+	for _, ad := range s.ads {
+		if query.After != nil && !query.After.before(ad) {
+			continue
+		}
+		if isActive(ad, now) && inSchedule(ad, now) && matchAd(ad, query) {
+			results = append(results, cloneFile(ad))
+		}
+	}
+	s.mu.RUnlock()
+
+	// the matching ads are sorted in go, unlike mongodb which sorts on its index
+	_, span := tracing.Start(ctx, "sort ads", attribute.Int("ads.count", len(results)))
+	sortByEndAt(results)
+	span.End()
+	return paginate(results, query.Offset, query.Limit)
+}
+
+// get the ad with the given id
+func (s *MemoryStore) Get(_ context.Context, id string) (File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ad, ok := s.ads[id]
+	if !ok {
+		return File{}, ErrNotFound
+	}
+	return cloneFile(ad), nil
+}
+
+// replace the ad with the given id
+func (s *MemoryStore) Update(_ context.Context, id string, ad File) error {
+	ad = cloneFile(ad)
+	ad.ID = id
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.ads[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !sameTimeRange(stored, ad) {
+		if err := s.checkActiveCap(ad); err != nil {
+			return err
+		}
+	}
+	s.ads[id] = ad
+	return nil
+}
+
+// change some fields of the ad with the given id
+func (s *MemoryStore) Patch(_ context.Context, id string, patch AdPatch) (File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ad, ok := s.ads[id]
+	if !ok {
+		return File{}, ErrNotFound
+	}
+	if !patch.matchBase(ad) {
+		return File{}, ErrAdChanged
+	}
+	patched := cloneFile(patch.Apply(ad))
+	if !sameTimeRange(ad, patched) {
+		if err := s.checkActiveCap(patched); err != nil {
+			return File{}, err
+		}
+	}
+	ad = patched
+	s.ads[id] = ad
+	return cloneFile(ad), nil
+}
+
+// check the ad does not make more ads active at the same moment than the limit, the stored version of the ad
+// is left out of the count, it is called with the lock held
+func (s *MemoryStore) checkActiveCap(ad File) error {
+	if s.quota.ActiveLimit <= 0 {
+		return nil
+	}
+	ads := make([]File, 0, len(s.ads))
+	for id, stored := range s.ads {
+		if id != ad.ID {
+			ads = append(ads, stored)
+		}
+	}
+	if active := maxOverlap(ads, ad.StartAt, ad.EndAt); active >= s.quota.ActiveLimit {
+		return errActiveCapExceeded(s.quota.ActiveLimit, active)
+	}
+	return nil
+}
+
+// delete the ad with the given id
+func (s *MemoryStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ads[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.ads, id)
+	return nil
+}
+
+// list the ads which have not ended
+func (s *MemoryStore) Snapshot(_ context.Context, now time.Time) ([]File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ads := make([]File, 0, len(s.ads))
+	for _, ad := range s.ads {
+		if ad.EndAt.After(now) {
+			ads = append(ads, cloneFile(ad))
+		}
+	}
+	return ads, nil
+}
+
+// get the ads created today and the ads active now
+func (s *MemoryStore) Usage(_ context.Context) (Usage, error) {
+	now := s.clock.Now()
+	day := quotaDay(now)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	active := 0
+	for _, ad := range s.ads {
+		if isActive(ad, now) {
+			active++
+		}
+	}
+	return Usage{
+		Date:        day,
+		Created:     s.created[day],
+		DailyLimit:  s.quota.DailyLimit,
+		Active:      active,
+		ActiveLimit: s.quota.ActiveLimit,
+	}, nil
+}
+
+// the in-memory store is always reachable
+func (s *MemoryStore) Ping(_ context.Context) error {
+	return nil
+}
+
+// deep copy an ad so the caller can not modify the stored one
+func cloneFile(ad File) File {
+	if ad.Schedule != nil {
+		schedule := *ad.Schedule
+		schedule.Days = cloneStrings(schedule.Days)
+		if schedule.Hours != nil {
+			schedule.Hours = append([]HourRange{}, schedule.Hours...)
+		}
+		ad.Schedule = &schedule
+	}
+	if ad.Conditions == nil {
+		return ad
+	}
+	conditions := make([]Condition, len(ad.Conditions))
+	for i, cond := range ad.Conditions {
+		conditions[i] = cond
+		conditions[i].Ages = cloneAges(cond.Ages)
+		conditions[i].Gender = cloneStrings(cond.Gender)
+		conditions[i].Country = cloneStrings(cond.Country)
+		conditions[i].Platform = cloneStrings(cond.Platform)
+		conditions[i].ExcludeGender = cloneStrings(cond.ExcludeGender)
+		conditions[i].ExcludeCountry = cloneStrings(cond.ExcludeCountry)
+		conditions[i].ExcludePlatform = cloneStrings(cond.ExcludePlatform)
+	}
+	ad.Conditions = conditions
+	return ad
+}
+
+// copy the age ranges and their bounds and keep nil as nil
+func cloneAges(ages []AgeRange) []AgeRange {
+	if ages == nil {
+		return nil
+	}
+	cloned := make([]AgeRange, len(ages))
+	for i, r := range ages {
+		if r.Min != nil {
+			cloned[i].Min = new(int)
+			*cloned[i].Min = *r.Min
+		}
+		if r.Max != nil {
+			cloned[i].Max = new(int)
+			*cloned[i].Max = *r.Max
+		}
+	}
+	return cloned
+}
+
+// copy a string slice and keep nil as nil
+func cloneStrings(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	return append([]string{}, list...)
+}
@@ -0,0 +1,129 @@
+package storage_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"dcard/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// test get, update and delete on the in-memory store
+func TestMemoryStore_CRUD(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	// insert a test ad
+	id, err := store.Insert(context.Background(), storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, "", id)
+
+	// get it
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD", ad.Title)
+	assert.Equal(t, id, ad.ID)
+
+	// update it
+	ad.Title = "test AD updated"
+	assert.NoError(t, store.Update(context.Background(), id, ad))
+	ad, err = store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD updated", ad.Title)
+
+	// patch it, the other fields are kept
+	title := "test AD patched"
+	patched, err := store.Patch(context.Background(), id, storage.AdPatch{Title: &title})
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD patched", patched.Title)
+	assert.True(t, ad.EndAt.Equal(patched.EndAt))
+
+	// delete it
+	assert.NoError(t, store.Delete(context.Background(), id))
+	_, err = store.Get(context.Background(), id)
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	// the ad is gone, so update and delete should fail
+	assert.Equal(t, storage.ErrNotFound, store.Update(context.Background(), id, ad))
+	_, err = store.Patch(context.Background(), id, storage.AdPatch{Title: &title})
+	assert.Equal(t, storage.ErrNotFound, err)
+	assert.Equal(t, storage.ErrNotFound, store.Delete(context.Background(), id))
+}
+
+// test the stored ad can not be modified through the returned one
+func TestMemoryStore_Copy(t *testing.T) {
+	store := storage.NewMemoryStore()
+	id, err := store.Insert(context.Background(), storage.File{
+		Title:      "test AD",
+		StartAt:    time.Now(),
+		EndAt:      time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{{Country: []string{"TW"}}},
+		Schedule:   &storage.Schedule{TimeZone: "Asia/Taipei", Days: []string{"mon"}, Hours: []storage.HourRange{{Start: 18, End: 23}}},
+	})
+	assert.NoError(t, err)
+
+	// change the returned ad
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	ad.Conditions[0].Country[0] = "JP"
+	ad.Schedule.Days[0] = "sun"
+	ad.Schedule.Hours[0].End = 24
+
+	// the stored ad should stay the same
+	ad, err = store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "TW", ad.Conditions[0].Country[0])
+	assert.Equal(t, "mon", ad.Schedule.Days[0])
+	assert.Equal(t, 23, ad.Schedule.Hours[0].End)
+}
+
+// test expired ads are not returned
+func TestMemoryStore_Expired(t *testing.T) {
+	store := storage.NewMemoryStore()
+	_, err := store.Insert(context.Background(), storage.File{
+		Title:   "test AD expired",
+		StartAt: time.Now().AddDate(0, 0, -2),
+		EndAt:   time.Now().AddDate(0, 0, -1),
+	})
+	assert.NoError(t, err)
+
+	result, err := store.Query(context.Background(), storage.QueryRequest{Offset: 0, Limit: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result))
+}
+
+// test the store is safe for concurrent insert and query
+func TestMemoryStore_Concurrent(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.Insert(context.Background(), storage.File{
+				Title:   "test AD" + strconv.Itoa(i),
+				StartAt: time.Now(),
+				EndAt:   time.Now().AddDate(0, 0, 1),
+			})
+			assert.NoError(t, err)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := store.Query(context.Background(), storage.QueryRequest{Offset: 0, Limit: 100})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	result, err := store.Query(context.Background(), storage.QueryRequest{Offset: 0, Limit: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 50, len(result))
+}
@@ -2,12 +2,22 @@ package storage
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
 
-	"github.com/spf13/viper"
+	"dcard/apperr"
+	"dcard/metrics"
+	"dcard/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // define the mongo-client struct
@@ -15,55 +25,402 @@ type MgoClient struct {
 	client     *mongo.Client
 	db         *mongo.Database
 	collection *mongo.Collection
+
+	// every operation goes through the breaker, and the idempotent ones are retried on a transient error
+	retry   RetryOptions
+	breaker *breaker
 }
 
-// insert an ad into the collection
-func (c *MgoClient) InsertOneRecord(user *File) error {
-	insertResult, err := c.collection.InsertOne(context.TODO(), user)
-	if err != nil {
+// define the connection pool options of the mongo-client, zero values keep the driver defaults
+type MgoOptions struct {
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	MaxConnIdleTime        time.Duration
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	Retry                  RetryOptions
+	Breaker                BreakerOptions
+}
+
+// insert an ad into the collection and return its id
+func (c *MgoClient) InsertOneRecord(ctx context.Context, user *File) (string, error) {
+	// an insert is not retried, it may have been written before the connection broke
+	var insertResult *mongo.InsertOneResult
+	err := c.do(ctx, false, func(ctx context.Context) (err error) {
+		insertResult, err = c.collection.InsertOne(ctx, user)
 		return err
+	})
+	if err != nil {
+		return "", mongoError(err)
 	}
 	id := insertResult.InsertedID.(primitive.ObjectID)
-	log.Println("Insert AD ID:", id.Hex())
+	slog.Debug("Insert ad", "id", id.Hex())
+	return id.Hex(), nil
+}
+
+// find the ad with the given id
+func (c *MgoClient) FindOneRecord(ctx context.Context, id string) (File, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return File{}, ErrNotFound
+	}
+	var result File
+	err = c.do(ctx, true, func(ctx context.Context) error {
+		return c.collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&result)
+	})
+	if err == mongo.ErrNoDocuments {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, mongoError(err)
+	}
+	return result, nil
+}
+
+// replace the ad with the given id
+func (c *MgoClient) ReplaceOneRecord(ctx context.Context, id string, user *File) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	// the _id can not be changed, so never write it back
+	replacement := *user
+	replacement.ID = ""
+	var result *mongo.UpdateResult
+	err = c.do(ctx, true, func(ctx context.Context) (err error) {
+		result, err = c.collection.ReplaceOne(ctx, bson.M{"_id": oid}, &replacement)
+		return err
+	})
+	if err != nil {
+		return mongoError(err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// set some fields of the ad with the given id and return the changed ad, the ad is only changed when it has
+// the expected values, otherwise ErrAdChanged is returned
+func (c *MgoClient) PatchOneRecord(ctx context.Context, id string, expect bson.M, fields bson.M) (File, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return File{}, ErrNotFound
+	}
+	filter := bson.M{"_id": oid}
+	for field, value := range expect {
+		filter[field] = value
+	}
+	var result File
+	findOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = c.do(ctx, true, func(ctx context.Context) error {
+		return c.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": fields}, findOptions).Decode(&result)
+	})
+	if err == mongo.ErrNoDocuments && len(expect) > 0 {
+		// tell a changed ad apart from a deleted one
+		if _, err := c.FindOneRecord(ctx, id); err != nil {
+			return File{}, err
+		}
+		return File{}, ErrAdChanged
+	}
+	if err == mongo.ErrNoDocuments {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, mongoError(err)
+	}
+	return result, nil
+}
+
+// delete the ad with the given id
+func (c *MgoClient) DeleteOneRecord(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	// a delete is not retried, a retry after the ad was deleted would answer that it does not exist
+	var result *mongo.DeleteResult
+	err = c.do(ctx, false, func(ctx context.Context) (err error) {
+		result, err = c.collection.DeleteOne(ctx, bson.M{"_id": oid})
+		return err
+	})
+	if err != nil {
+		return mongoError(err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
-// establish a new mongo-client
-func NewMgoClient(uri, database, table string) (*MgoClient, error) {
-	clientOptions := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(context.Background(), clientOptions)
+// the collection holding the daily creation counters, next to the ads
+func (c *MgoClient) counterCollection() *mongo.Collection {
+	return c.db.Collection(c.collection.Name() + "_quota")
+}
+
+// add one to the creation counter of the day unless it has reached the limit, and return the counter
+func (c *MgoClient) IncrDailyCount(ctx context.Context, day string, limit int) (int, bool, error) {
+	filter := bson.M{"_id": day}
+	if limit > 0 {
+		filter["count"] = bson.M{"$lt": limit}
+	}
+	updateOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	// the upsert of a full counter collides with it, but so does a concurrent upsert of a new day, so try again
+	for attempt := 0; attempt < 3; attempt++ {
+		var counter struct {
+			Count int `bson:"count"`
+		}
+		// an increment is not retried, so the counter is never taken twice
+		err := c.do(ctx, false, func(ctx context.Context) error {
+			return c.counterCollection().FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"count": 1}}, updateOptions).Decode(&counter)
+		})
+		if err == nil {
+			return counter.Count, true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return 0, false, mongoError(err)
+		}
+		count, err := c.DailyCount(ctx, day)
+		if err != nil {
+			return 0, false, err
+		}
+		if limit > 0 && count >= limit {
+			return count, false, nil
+		}
+	}
+	return 0, false, apperr.New(apperr.Unavailable, "store_unavailable", "the daily counter is busy")
+}
+
+// take back one from the creation counter of the day
+func (c *MgoClient) DecrDailyCount(ctx context.Context, day string) error {
+	err := c.do(ctx, false, func(ctx context.Context) error {
+		_, err := c.counterCollection().UpdateOne(ctx, bson.M{"_id": day}, bson.M{"$inc": bson.M{"count": -1}})
+		return err
+	})
+	return mongoError(err)
+}
+
+// get the creation counter of the day
+func (c *MgoClient) DailyCount(ctx context.Context, day string) (int, error) {
+	var counter struct {
+		Count int `bson:"count"`
+	}
+	err := c.do(ctx, true, func(ctx context.Context) error {
+		return c.counterCollection().FindOne(ctx, bson.M{"_id": day}).Decode(&counter)
+	})
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	return counter.Count, nil
+}
+
+// count the most ads active at the same moment during [startAt, endAt)
+func (c *MgoClient) MaxActiveRecords(ctx context.Context, startAt, endAt time.Time) (int, error) {
+	filter := bson.M{"startat": bson.M{"$lt": endAt}, "endat": bson.M{"$gt": startAt}}
+	findOptions := options.Find().SetProjection(bson.M{"startat": 1, "endat": 1})
+	var ads []File
+	err := c.do(ctx, true, func(ctx context.Context) error {
+		return c.findAll(ctx, filter, &ads, findOptions)
+	})
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	return maxOverlap(ads, startAt, endAt), nil
+}
+
+// count the ads active at the given moment
+func (c *MgoClient) CountActiveRecords(ctx context.Context, now time.Time) (int, error) {
+	var count int64
+	err := c.do(ctx, true, func(ctx context.Context) (err error) {
+		count, err = c.collection.CountDocuments(ctx, bson.M{"startat": bson.M{"$lte": now}, "endat": bson.M{"$gt": now}})
+		return err
+	})
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	return int(count), nil
+}
+
+// list the time zones of the schedules of the ads active at the given moment
+func (c *MgoClient) ScheduleTimeZones(ctx context.Context, now time.Time) ([]string, error) {
+	filter := bson.M{"startat": bson.M{"$lte": now}, "endat": bson.M{"$gt": now}, "schedule.timezone": bson.M{"$type": "string"}}
+	var values []any
+	err := c.do(ctx, true, func(ctx context.Context) (err error) {
+		values, err = c.collection.Distinct(ctx, "schedule.timezone", filter)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, mongoError(err)
+	}
+	zones := make([]string, 0, len(values))
+	for _, value := range values {
+		if zone, ok := value.(string); ok {
+			zones = append(zones, zone)
+		}
+	}
+	return zones, nil
+}
+
+// find the ads matching the filter and decode all of them into the results
+func (c *MgoClient) findAll(ctx context.Context, filter any, results *[]File, opts ...*options.FindOptions) error {
+	cursor, err := c.collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, results)
+}
+
+// establish a new mongo-client, it holds a connection pool and should be shared by all requests, the context bounds
+// the connection and the first ping
+func NewMgoClient(ctx context.Context, uri, database, table string, mgoOptions MgoOptions) (*MgoClient, error) {
+	clientOptions := options.Client().ApplyURI(uri).SetMonitor(commandMonitor())
+	if mgoOptions.MaxPoolSize != 0 {
+		clientOptions.SetMaxPoolSize(mgoOptions.MaxPoolSize)
+	}
+	if mgoOptions.MinPoolSize != 0 {
+		clientOptions.SetMinPoolSize(mgoOptions.MinPoolSize)
+	}
+	if mgoOptions.MaxConnIdleTime != 0 {
+		clientOptions.SetMaxConnIdleTime(mgoOptions.MaxConnIdleTime)
+	}
+	if mgoOptions.ConnectTimeout != 0 {
+		clientOptions.SetConnectTimeout(mgoOptions.ConnectTimeout)
+	}
+	if mgoOptions.ServerSelectionTimeout != 0 {
+		clientOptions.SetServerSelectionTimeout(mgoOptions.ServerSelectionTimeout)
+	}
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, mongoError(err)
 	}
 	// ping to try if it is connected
-	if err = client.Ping(context.Background(), nil); err != nil {
-		log.Println(err)
-		return nil, err
+	if err = client.Ping(ctx, nil); err != nil {
+		slog.Error("Fail to ping MongoDB", "err", err)
+		CloseMongoDB(client)
+		return nil, mongoError(err)
 	}
-	log.Println("Connected to MongoDB")
+	slog.Info("Connected to MongoDB")
 	db := client.Database(database)
 	collection := db.Collection(table)
-	return &MgoClient{client: client, db: db, collection: collection}, nil
+	return &MgoClient{client: client, db: db, collection: collection, retry: mgoOptions.Retry, breaker: newBreaker(mgoOptions.Breaker)}, nil
 }
 
-// close the mongo-client
-func CloseMongoDB(client *mongo.Client) {
-	if err := client.Disconnect(context.TODO()); err != nil {
-		log.Println(err)
+// observe the latency and the failures of every command sent by the mongo-client, and trace each command
+// under the span of the operation which sent it
+func commandMonitor() *event.CommandMonitor {
+	// the spans of the commands in flight, by the id of their request
+	var spans sync.Map
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			_, span := tracing.StartClient(ctx, commandSpanName(e), attribute.String("db.system.name", "mongodb"),
+				attribute.String("db.namespace", e.DatabaseName),
+				attribute.String("db.operation.name", e.CommandName),
+				attribute.String("db.collection.name", commandCollection(e.Command)),
+			)
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			metrics.MongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			if span, ok := spans.LoadAndDelete(e.RequestID); ok {
+				tracing.End(span.(trace.Span), nil)
+			}
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			metrics.MongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			metrics.MongoErrors.WithLabelValues(e.CommandName).Inc()
+			if span, ok := spans.LoadAndDelete(e.RequestID); ok {
+				tracing.End(span.(trace.Span), errors.New(e.Failure))
+			}
+		},
+	}
+}
+
+// name the span of a command by the command and its collection, like "find ads"
+func commandSpanName(e *event.CommandStartedEvent) string {
+	if collection := commandCollection(e.Command); collection != "" {
+		return e.CommandName + " " + collection
+	}
+	return e.CommandName
+}
+
+// get the collection of a command, it is the value of the first element in the commands on a collection
+func commandCollection(command bson.Raw) string {
+	elem, err := command.IndexErr(0)
+	if err != nil {
+		return ""
+	}
+	collection, _ := elem.Value().StringValueOK()
+	return collection
+}
+
+// create the indexes used by the query, creating an existing index is a no-op
+func (c *MgoClient) EnsureIndexes(ctx context.Context) error {
+	indexes := []mongo.IndexModel{
+		// sort by end time and page through the results
+		{Keys: bson.D{{Key: "endat", Value: 1}, {Key: "_id", Value: 1}}},
+		// the active window
+		{Keys: bson.D{{Key: "startat", Value: 1}, {Key: "endat", Value: 1}}},
+		// the targeting, a compound index can only hold one array so each field has its own
+		{Keys: bson.D{{Key: "conditions.agestart", Value: 1}, {Key: "conditions.ageend", Value: 1}, {Key: "endat", Value: 1}}},
+		{Keys: bson.D{{Key: "conditions.ages.min", Value: 1}, {Key: "conditions.ages.max", Value: 1}, {Key: "endat", Value: 1}}},
+		{Keys: bson.D{{Key: "conditions.gender", Value: 1}, {Key: "endat", Value: 1}}},
+		{Keys: bson.D{{Key: "conditions.country", Value: 1}, {Key: "endat", Value: 1}}},
+		{Keys: bson.D{{Key: "conditions.platform", Value: 1}, {Key: "endat", Value: 1}}},
 	}
-	log.Println("Disconnected from MongoDB")
+	names, err := c.collection.Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		return mongoError(err)
+	}
+	slog.Info("Ensured MongoDB indexes", "names", names)
+	return nil
 }
 
-// read the info of mongodb from config file
-func SetUri(config string) (string, string, string, error) {
-	viper.SetConfigType("toml")
-	viper.SetConfigFile(config)
-	if err := viper.ReadInConfig(); err != nil {
-		log.Println("Error reading configuration file:", err)
-		return "", "", "", err
+// the longest time to wait for mongodb to answer a ping
+const pingTimeout = 2 * time.Second
+
+// ping the primary of mongodb
+func (c *MgoClient) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return mongoError(c.client.Ping(ctx, nil))
+}
+
+// close the connection pool of the mongo-client
+func (c *MgoClient) Close() {
+	CloseMongoDB(c.client)
+}
+
+// classify the error from the driver, so the handlers can tell an unreachable mongodb from a bug, a deadline hit or
+// a canceled request is kept as it is for apperr.From
+func mongoError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return err
+	case mongo.IsDuplicateKeyError(err):
+		return apperr.Wrap(apperr.Conflict, "ad_conflict", "the ad conflicts with an existing one", err)
+	case isTransient(err), mongo.IsTimeout(err), errors.Is(err, mongo.ErrClientDisconnected):
+		return apperr.Wrap(apperr.Unavailable, "store_unavailable", "the ad store is unavailable", err)
+	default:
+		return err
+	}
+}
+
+// the longest time to wait for the connections in use to be returned to the pool when the mongo-client is closed
+const disconnectTimeout = 5 * time.Second
+
+// close the mongo-client
+func CloseMongoDB(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	if err := client.Disconnect(ctx); err != nil {
+		slog.Error("Fail to disconnect from MongoDB", "err", err)
 	}
-	uri := viper.GetString("mongodb.uri")
-	database := viper.GetString("mongodb.database")
-	collection := viper.GetString("mongodb.collection")
-	return uri, database, collection, nil
+	slog.Info("Disconnected from MongoDB")
 }
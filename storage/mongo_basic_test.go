@@ -1,50 +1,79 @@
-package storage_test
+package storage
 
 import (
 	"context"
-	"log"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/spf13/viper"
+	"dcard/apperr"
+	"dcard/config"
+	"dcard/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// define the mongo-client struct
-type MgoClient struct {
-	client     *mongo.Client
-	db         *mongo.Database
-	collection *mongo.Collection
-}
+// remember if the test mongodb is reachable, so it is only checked once
+var (
+	mongoOnce    sync.Once
+	mongoPingErr error
+)
 
-// insert an ad into the collection
-func (c *MgoClient) InsertOneRecord(user *File) error {
-	insertResult, err := c.collection.InsertOne(context.TODO(), user)
+// read the settings of the test mongodb
+func testMongoConfig(t testing.TB) config.MongoDB {
+	cfg, err := config.LoadFile("test.conf", nil)
 	if err != nil {
-		return err
+		t.Fatalf("LoadFile returned an error: %v", err)
 	}
-	id := insertResult.InsertedID.(primitive.ObjectID)
-	log.Println("Insert AD ID:", id.Hex())
-	return nil
+	return cfg.MongoDB
 }
 
-// test insertonerecord
-func TestInsertOneRecord(t *testing.T) {
-	// set uri
-	uri, database, collection, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
+// establish a mongo-client with the settings of the test mongodb
+func newTestMgoClient(t testing.TB) (*MgoClient, error) {
+	mgo := testMongoConfig(t)
+	return NewMgoClient(context.Background(), mgo.URI, mgo.Database, mgo.Collection, MgoOptions{
+		MaxPoolSize:            mgo.MaxPoolSize,
+		MinPoolSize:            mgo.MinPoolSize,
+		MaxConnIdleTime:        mgo.MaxConnIdleTime,
+		ConnectTimeout:         mgo.ConnectTimeout,
+		ServerSelectionTimeout: mgo.ServerSelectionTimeout,
+	})
+}
 
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+// connect to the test mongodb, the test is skipped when no mongod is running
+func connectTestMongo(t testing.TB) (*mongo.Client, string, string) {
+	mgo := testMongoConfig(t)
+	uri, database, collection := mgo.URI, mgo.Database, mgo.Collection
+	clientOptions := options.Client().ApplyURI(uri).SetServerSelectionTimeout(2 * time.Second)
+	client, err := mongo.Connect(context.Background(), clientOptions)
 	if err != nil {
 		t.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
+	mongoOnce.Do(func() { mongoPingErr = client.Ping(context.Background(), nil) })
+	if mongoPingErr != nil {
+		client.Disconnect(context.Background())
+		t.Skipf("MongoDB is not reachable at %s: %v", uri, mongoPingErr)
+	}
+	return client, database, collection
+}
+
+// test insertonerecord
+func TestInsertOneRecord(t *testing.T) {
+	// establish a test client
+	client, database, collection := connectTestMongo(t)
 
 	// create a test db
 	db := client.Database(database)
@@ -64,7 +93,7 @@ func TestInsertOneRecord(t *testing.T) {
 	}
 
 	// call insert function
-	err = testClient.InsertOneRecord(ad)
+	id, err := testClient.InsertOneRecord(context.Background(), ad)
 	if err != nil {
 		t.Errorf("Failed to insert test record: %v", err)
 	}
@@ -85,6 +114,9 @@ func TestInsertOneRecord(t *testing.T) {
 	if insertedAd.Title != ad.Title {
 		t.Errorf("Inserted ad title does not match. Got: %s, Want: %s", insertedAd.Title, ad.Title)
 	}
+	if insertedAd.ID != id {
+		t.Errorf("Inserted ad id does not match. Got: %s, Want: %s", insertedAd.ID, id)
+	}
 
 	// drop this test db
 	err = client.Database(database).Drop(context.Background())
@@ -98,44 +130,71 @@ func TestInsertOneRecord(t *testing.T) {
 	}
 }
 
-// establish a new mongo-client
-func NewMgoClient(uri, database, table string) (*MgoClient, error) {
-	clientOptions := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(context.Background(), clientOptions)
+// test findonerecord, replaceonerecord, patchonerecord and deleteonerecord
+func TestRecordByID(t *testing.T) {
+	// establish a test client
+	client, database, collection := connectTestMongo(t)
+	db := client.Database(database)
+	testClient := &MgoClient{
+		client:     client,
+		db:         db,
+		collection: db.Collection(collection),
+	}
+
+	// insert a test ad
+	id, err := testClient.InsertOneRecord(context.Background(), &File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now()})
 	if err != nil {
-		return nil, err
+		t.Fatalf("Failed to insert test record: %v", err)
 	}
-	// ping to try if it is connected
-	if err = client.Ping(context.Background(), nil); err != nil {
-		log.Println(err)
-		return nil, err
+
+	// find it
+	found, err := testClient.FindOneRecord(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD", found.Title)
+
+	// replace it
+	found.Title = "test AD replaced"
+	assert.NoError(t, testClient.ReplaceOneRecord(context.Background(), id, &found))
+	found, err = testClient.FindOneRecord(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD replaced", found.Title)
+
+	// patch it, the other fields are kept
+	patched, err := testClient.PatchOneRecord(context.Background(), id, nil, bson.M{"title": "test AD patched"})
+	assert.NoError(t, err)
+	assert.Equal(t, "test AD patched", patched.Title)
+	assert.True(t, found.EndAt.Equal(patched.EndAt))
+
+	// delete it, then it should not be found anymore
+	assert.NoError(t, testClient.DeleteOneRecord(context.Background(), id))
+	_, err = testClient.FindOneRecord(context.Background(), id)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, testClient.DeleteOneRecord(context.Background(), id))
+	assert.Equal(t, ErrNotFound, testClient.DeleteOneRecord(context.Background(), "not-an-object-id"))
+
+	// drop this test db
+	if err := db.Drop(context.Background()); err != nil {
+		t.Fatalf("Failed to drop test database: %v", err)
 	}
-	log.Println("Connected to MongoDB")
-	db := client.Database(database)
-	collection := db.Collection(table)
-	return &MgoClient{client: client, db: db, collection: collection}, nil
+	CloseMongoDB(client)
 }
 
 // test newmgoclient
 func TestNewMgoClient(t *testing.T) {
-	// get mongo info
-	uri, database, collection, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
+	// skip when no mongod is running
+	testClient, database, collection := connectTestMongo(t)
+	CloseMongoDB(testClient)
 
 	// establish a new client instance
-	client, err := NewMgoClient(uri, database, collection)
-	defer func() {
-		if err := client.client.Disconnect(context.Background()); err != nil {
-			t.Fatalf("Failed to disconnect from MongoDB: %v", err)
-		}
-	}()
-
-	// check client is not nil
-	assert.NotNil(t, client)
+	client, err := newTestMgoClient(t)
 	// check err is nil
 	assert.NoError(t, err)
+	// check client is not nil
+	if !assert.NotNil(t, client) {
+		return
+	}
+	defer client.Close()
+
 	// check the database info is correct
 	assert.Equal(t, client.db.Name(), database)
 	assert.Equal(t, client.collection.Name(), collection)
@@ -147,27 +206,10 @@ func TestNewMgoClient(t *testing.T) {
 	}
 }
 
-// close the mongo-client
-func CloseMongoDB(client *mongo.Client) {
-	if err := client.Disconnect(context.TODO()); err != nil {
-		log.Println(err)
-	}
-	log.Println("Disconnected from MongoDB")
-}
-
 // test closemongodb
 func TestCloseMongoDB(t *testing.T) {
-	// set uri
-	uri, _, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
 	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
+	client, _, _ := connectTestMongo(t)
 
 	// ping to check it has connected
 	assert.True(t, client.Ping(context.Background(), nil) == nil)
@@ -179,47 +221,111 @@ func TestCloseMongoDB(t *testing.T) {
 	assert.True(t, client.Ping(context.Background(), nil) != nil)
 }
 
-// read the info of mongodb from config file
-func SetUri(config string) (string, string, string, error) {
-	viper.SetConfigType("toml")
-	viper.SetConfigFile("test.conf")
-	if err := viper.ReadInConfig(); err != nil {
-		log.Println("Error reading configuration file:", err)
-		return "", "", "", err
-	}
-	uri := viper.GetString("mongodb.uri")
-	database := viper.GetString("mongodb.database")
-	collection := viper.GetString("mongodb.collection")
-	return uri, database, collection, nil
+// test ensureindexes
+func TestEnsureIndexes(t *testing.T) {
+	store := newTestMongoStore(t)
+
+	// it can be called again at every startup
+	assert.NoError(t, store.client.EnsureIndexes(context.Background()))
+	assert.NoError(t, store.client.EnsureIndexes(context.Background()))
+
+	// check the indexes exist
+	cursor, err := store.client.collection.Indexes().List(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list indexes: %v", err)
+	}
+	var indexes []bson.M
+	if err := cursor.All(context.Background(), &indexes); err != nil {
+		t.Fatalf("Failed to decode indexes: %v", err)
+	}
+	names := make([]string, 0)
+	for _, index := range indexes {
+		names = append(names, index["name"].(string))
+	}
+	assert.Contains(t, names, "endat_1__id_1")
+	assert.Contains(t, names, "startat_1_endat_1")
+	assert.Contains(t, names, "conditions.agestart_1_conditions.ageend_1_endat_1")
+	assert.Contains(t, names, "conditions.gender_1_endat_1")
+	assert.Contains(t, names, "conditions.country_1_endat_1")
+	assert.Contains(t, names, "conditions.platform_1_endat_1")
 }
 
-// test seturi
-func TestSetUri(t *testing.T) {
-	// get correct mongodb info
-	viper.SetConfigType("toml")
-	viper.SetConfigFile("test.conf")
-	if err := viper.ReadInConfig(); err != nil {
-		t.Fatalf("Failed to read configuration file: %v", err)
-		return
+// test the monitor observes the latency of every command and counts the failed ones
+func TestCommandMonitor(t *testing.T) {
+	monitor := commandMonitor()
+	failed := metrics.MongoErrors.WithLabelValues("testMonitor")
+	before := testutil.ToFloat64(failed)
+
+	monitor.Succeeded(context.Background(), &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "testMonitor", Duration: time.Millisecond}})
+	monitor.Failed(context.Background(), &event.CommandFailedEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "testMonitor", Duration: time.Second}})
+	assert.Equal(t, before+1, testutil.ToFloat64(failed))
+
+	var latency dto.Metric
+	if err := metrics.MongoDuration.WithLabelValues("testMonitor").(prometheus.Histogram).Write(&latency); err != nil {
+		t.Fatal(err)
 	}
-	expected_uri := viper.GetString("mongodb.uri")
-	expected_database := viper.GetString("mongodb.database")
-	expected_collection := viper.GetString("mongodb.collection")
+	assert.Equal(t, uint64(2), latency.GetHistogram().GetSampleCount())
+	assert.Equal(t, 1.001, latency.GetHistogram().GetSampleSum())
+}
 
-	// get test info
-	uri, database, collection, err := SetUri("test.conf")
+// test every command is traced under the span of its operation, and a failed command fails its span
+func TestCommandMonitor_Trace(t *testing.T) {
+	recorder := recordSpans(t)
+	monitor := commandMonitor()
+	ctx, operation := otel.Tracer("test").Start(context.Background(), "QueryData")
+	find, err := bson.Marshal(bson.D{{Key: "find", Value: "ads"}, {Key: "filter", Value: bson.D{}}})
 	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
+		t.Fatal(err)
+	}
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: find, DatabaseName: "dcard-ads", CommandName: "find", RequestID: 1})
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: find, DatabaseName: "dcard-ads", CommandName: "find", RequestID: 2})
+	monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", RequestID: 1}})
+	monitor.Failed(ctx, &event.CommandFailedEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", RequestID: 2}, Failure: "test failure"})
+	operation.End()
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	for _, span := range spans[:2] {
+		assert.Equal(t, "find ads", span.Name())
+		assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+		assert.Equal(t, operation.SpanContext().SpanID(), span.Parent().SpanID())
+		assert.Contains(t, span.Attributes(), attribute.String("db.collection.name", "ads"))
+		assert.Contains(t, span.Attributes(), attribute.String("db.namespace", "dcard-ads"))
 	}
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "test failure", spans[1].Status().Description)
+}
+
+// test the errors from the driver are classified
+func TestMongoError(t *testing.T) {
+	assert.Nil(t, mongoError(nil))
 
-	// check it
-	if uri != expected_uri {
-		t.Errorf("SetUri returned incorrect URI. Got: %s, Want: %s", uri, expected_uri)
+	// a duplicate key is a conflict
+	duplicate := mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key error"}}}
+	assert.Equal(t, apperr.Conflict, apperr.From(mongoError(duplicate)).Kind)
+
+	// an unreachable mongodb is unavailable
+	unreachable := []error{
+		topology.ServerSelectionError{Wrapped: errors.New("connection refused")},
+		mongo.ErrClientDisconnected,
 	}
-	if database != expected_database {
-		t.Errorf("SetUri returned incorrect database name. Got: %s, Want: %s", database, expected_database)
+	for _, err := range unreachable {
+		assert.Equal(t, apperr.Unavailable, apperr.From(mongoError(err)).Kind, err.Error())
 	}
-	if collection != expected_collection {
-		t.Errorf("SetUri returned incorrect collection name. Got: %s, Want: %s", collection, expected_collection)
+
+	// the deadline of the operation is a timeout, even when it is hit while selecting a server
+	for _, err := range []error{context.DeadlineExceeded, topology.ServerSelectionError{Wrapped: context.DeadlineExceeded}} {
+		assert.Equal(t, apperr.Timeout, apperr.From(mongoError(err)).Kind, err.Error())
 	}
+	assert.Equal(t, "canceled", apperr.From(mongoError(context.Canceled)).Code)
+
+	// the cause is kept in the chain
+	assert.True(t, errors.Is(mongoError(context.DeadlineExceeded), context.DeadlineExceeded))
+
+	// any other error is kept as it is
+	other := errors.New("something is broken")
+	assert.Equal(t, other, mongoError(other))
 }
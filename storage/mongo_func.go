@@ -2,169 +2,408 @@ package storage
 
 import (
 	"context"
-	"errors"
-	"log"
-	"sort"
+	"log/slog"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// set the ad struct from POST request and the real ad struct
-type Condition struct {
-	AgeStart int      `json:"agestart"`
-	AgeEnd   int      `json:"ageend"`
-	Gender   []string `json:"gender"`
-	Country  []string `json:"country"`
-	Platform []string `json:"platform"`
-}
-type File struct {
-	Title      string      `json:"title"`
-	StartAt    time.Time   `json:"startat"`
-	EndAt      time.Time   `json:"endat"`
-	Conditions []Condition `json:"conditions"`
-}
-type AdData struct {
-	ClientIP string
-	Headers  map[string][]string
-	Ad       File
-}
-
-// set the query struct from GET request
-type QueryRequest struct {
-	ClientIP string
-	Headers  map[string][]string
-	Offset   int
-	Limit    int
-	Age      int
-	Gender   string
-	Country  string
-	Platform string
-}
-
-// insert ad into mongodb
-func StoreData(ad AdData) error {
-	printLogPostRequest(ad)
-
-	// set mongodb connection
-	uri, database, collection, err := SetUri("project.conf")
+// define the mongodb backend of the ad store
+type MongoStore struct {
+	client *MgoClient
+	clock  Clock
+	quota  Quota
+}
+
+var _ SnapshotSource = (*MongoStore)(nil)
+
+// establish a new mongodb store on a long-lived mongo-client
+func NewMongoStore(client *MgoClient, opts ...Option) *MongoStore {
+	o := newStoreOptions(opts)
+	return &MongoStore{client: client, clock: o.clock, quota: o.quota}
+}
+
+// insert ad into mongodb, the daily counter is taken before and the active cap is verified after the insert
+func (s *MongoStore) Insert(ctx context.Context, ad File) (string, error) {
+	// the id is always generated by mongodb
+	ad.ID = ""
+	day := quotaDay(s.clock.Now())
+
+	// the conditional increment is atomic, so concurrent inserts can not pass the daily limit together
+	created, ok, err := s.client.IncrDailyCount(ctx, day, s.quota.DailyLimit)
 	if err != nil {
-		return err
+		return "", err
 	}
-	mgoClient, err := NewMgoClient(uri, database, collection)
+	if !ok {
+		return "", errDailyQuotaExceeded(s.quota.DailyLimit, created)
+	}
+	id, err := s.client.InsertOneRecord(ctx, &ad)
 	if err != nil {
-		return err
+		s.rollbackDailyCount(ctx, day)
+		return "", err
 	}
-	defer CloseMongoDB(mgoClient.client)
 
-	// insert
-	if err = mgoClient.InsertOneRecord(&ad.Ad); err != nil {
-		return err
+	// the ad counts itself, so a concurrent insert sees it and at worst both of them are rolled back
+	if err := s.checkActiveCap(ctx, ad); err != nil {
+		rollbackCtx, cancel := rollbackContext(ctx)
+		defer cancel()
+		if err := s.client.DeleteOneRecord(rollbackCtx, id); err != nil {
+			slog.Error("Fail to roll back the ad", "id", id, "err", err)
+		}
+		s.rollbackDailyCount(ctx, day)
+		return "", err
 	}
+	return id, nil
+}
 
+// check the written ad does not make more ads active at the same moment than the limit, the ad counts itself
+func (s *MongoStore) checkActiveCap(ctx context.Context, ad File) error {
+	if s.quota.ActiveLimit <= 0 {
+		return nil
+	}
+	active, err := s.client.MaxActiveRecords(ctx, ad.StartAt, ad.EndAt)
+	if err != nil {
+		return err
+	}
+	if active > s.quota.ActiveLimit {
+		return errActiveCapExceeded(s.quota.ActiveLimit, active-1)
+	}
 	return nil
 }
 
-// query ad from db
-func QueryData(query QueryRequest) ([]File, error) {
-	printLogGetRequest(query)
+// set the given fields of the written ad back to the old ad after the active cap was exceeded, it is only undone
+// when the ad still has the written time range, so a later change of another request is kept
+func (s *MongoStore) rollbackRecord(ctx context.Context, written, old File, fields []string) {
+	ctx, cancel := rollbackContext(ctx)
+	defer cancel()
+	values := recordFields(old)
+	restore := bson.M{}
+	for _, field := range fields {
+		restore[field] = values[field]
+	}
+	expect := bson.M{"startat": written.StartAt, "endat": written.EndAt}
+	if _, err := s.client.PatchOneRecord(ctx, written.ID, expect, restore); err != nil {
+		slog.Error("Fail to roll back the ad", "id", written.ID, "err", err)
+	}
+}
 
-	// set mongodb connection
-	uri, database, collection, err := SetUri("project.conf")
+// the stored fields of an ad, except its id
+func recordFields(ad File) bson.M {
+	return bson.M{
+		"title":      ad.Title,
+		"startat":    ad.StartAt,
+		"endat":      ad.EndAt,
+		"conditions": ad.Conditions,
+		"schedule":   ad.Schedule,
+	}
+}
+
+// the longest time a rollback may take, it is not bounded by the deadline of the request which may already be hit
+const rollbackTimeout = 5 * time.Second
+
+// derive the context of a rollback, it outlives the request so a failed insert is still undone after its deadline
+func rollbackContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+}
+
+// give back the daily counter taken by a failed insert, even when the request is gone
+func (s *MongoStore) rollbackDailyCount(ctx context.Context, day string) {
+	ctx, cancel := rollbackContext(ctx)
+	defer cancel()
+	if err := s.client.DecrDailyCount(ctx, day); err != nil {
+		slog.Error("Fail to roll back the daily counter", "day", day, "err", err)
+	}
+}
+
+// query ad from db
+func (s *MongoStore) Query(ctx context.Context, query QueryRequest) ([]File, error) {
+	// set filter
+	now := s.clock.Now()
+	zones, err := s.client.ScheduleTimeZones(ctx, now)
 	if err != nil {
 		return []File{}, err
 	}
-	mgoClient, err := NewMgoClient(uri, database, collection)
+	filter := queryFilter(query, now, zones)
+	if query.After != nil {
+		after, err := afterFilter(*query.After)
+		if err != nil {
+			return []File{}, err
+		}
+		filter = bson.M{"$and": []bson.M{filter, after}}
+	}
+
+	// sort, skip and limit in mongodb, the id breaks the tie so the order is stable
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "endat", Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(query.Offset)).
+		SetLimit(int64(query.Limit))
+
+	// realize finding data, a query is read-only so it is retried on a transient error
+	results := make([]File, 0)
+	err = s.client.do(ctx, true, func(ctx context.Context) error {
+		return s.client.findAll(ctx, filter, &results, findOptions)
+	})
 	if err != nil {
-		return []File{}, err
+		return []File{}, mongoError(err)
 	}
-	defer CloseMongoDB(mgoClient.client)
 
-	// set filter
-	filter := bson.M{}
-	filter["endat"] = bson.M{"$gt": time.Now()}
-	if query.Age != 0 {
-		filter["$or"] = []bson.M{
-			{"$and": []bson.M{
-				{"conditions.agestart": bson.M{"$lte": query.Age}},
-				{"conditions.ageend": bson.M{"$gte": query.Age}},
-			}},
-			{"$and": []bson.M{
-				{"conditions.agestart": 0},
-				{"conditions.ageend": 0},
-			}},
+	// an empty page is only an error when the offset is beyond all the results
+	if len(results) == 0 && query.Offset > 0 {
+		var count int64
+		err := s.client.do(ctx, true, func(ctx context.Context) (err error) {
+			count, err = s.client.collection.CountDocuments(ctx, filter)
+			return err
+		})
+		if err != nil {
+			return []File{}, mongoError(err)
 		}
-	}
-	if query.Gender != "" {
-		filter["$or"] = []bson.M{
-			{"conditions.gender": query.Gender},
-			{"conditions.gender": nil},
+		if int64(query.Offset) > count {
+			return []File{}, ErrOffsetOutOfRange
 		}
 	}
-	if query.Country != "" {
-		filter["$or"] = []bson.M{
-			{"conditions.country": query.Country},
-			{"conditions.country": nil},
+	return results, nil
+}
+
+// get the ad with the given id from db
+func (s *MongoStore) Get(ctx context.Context, id string) (File, error) {
+	return s.client.FindOneRecord(ctx, id)
+}
+
+// replace the ad with the given id in db, a changed time range is checked against the active cap after the write
+func (s *MongoStore) Update(ctx context.Context, id string, ad File) error {
+	if s.quota.ActiveLimit <= 0 {
+		return s.client.ReplaceOneRecord(ctx, id, &ad)
+	}
+	old, err := s.client.FindOneRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.client.ReplaceOneRecord(ctx, id, &ad); err != nil {
+		return err
+	}
+	ad.ID = id
+	if sameTimeRange(old, ad) {
+		return nil
+	}
+	if err := s.checkActiveCap(ctx, ad); err != nil {
+		s.rollbackRecord(ctx, ad, old, []string{"title", "startat", "endat", "conditions", "schedule"})
+		return err
+	}
+	return nil
+}
+
+// change some fields of the ad with the given id in db
+func (s *MongoStore) Patch(ctx context.Context, id string, patch AdPatch) (File, error) {
+	fields := bson.M{}
+	if patch.Title != nil {
+		fields["title"] = *patch.Title
+	}
+	if patch.StartAt != nil {
+		fields["startat"] = *patch.StartAt
+	}
+	if patch.EndAt != nil {
+		fields["endat"] = *patch.EndAt
+	}
+	if patch.Conditions != nil {
+		fields["conditions"] = *patch.Conditions
+	}
+	if patch.Schedule.Set {
+		fields["schedule"] = patch.Schedule.Schedule
+	}
+	if len(fields) == 0 {
+		return s.client.FindOneRecord(ctx, id)
+	}
+
+	// the old ad is read first when the time range is moved, so it can be restored when the active cap is exceeded
+	moved := s.quota.ActiveLimit > 0 && (patch.StartAt != nil || patch.EndAt != nil)
+	var old File
+	if moved {
+		var err error
+		if old, err = s.client.FindOneRecord(ctx, id); err != nil {
+			return File{}, err
 		}
 	}
-	if query.Platform != "" {
-		filter["$or"] = []bson.M{
-			{"conditions.platform": query.Platform},
-			{"conditions.Platform": nil},
+
+	// the ad is only changed when it still has the time range the patch was checked against
+	var expect bson.M
+	if patch.Base != nil {
+		expect = bson.M{"startat": patch.Base.StartAt, "endat": patch.Base.EndAt}
+	}
+	patched, err := s.client.PatchOneRecord(ctx, id, expect, fields)
+	if err != nil || !moved || sameTimeRange(old, patched) {
+		return patched, err
+	}
+	if err := s.checkActiveCap(ctx, patched); err != nil {
+		changed := make([]string, 0, len(fields))
+		for field := range fields {
+			changed = append(changed, field)
 		}
+		s.rollbackRecord(ctx, patched, old, changed)
+		return File{}, err
 	}
+	return patched, nil
+}
 
-	// set filter to cursor
-	cursor, err := mgoClient.collection.Find(context.Background(), filter)
+// delete the ad with the given id from db
+func (s *MongoStore) Delete(ctx context.Context, id string) error {
+	return s.client.DeleteOneRecord(ctx, id)
+}
+
+// list the ads which have not ended from db
+func (s *MongoStore) Snapshot(ctx context.Context, now time.Time) ([]File, error) {
+	ads := make([]File, 0)
+	err := s.client.do(ctx, true, func(ctx context.Context) error {
+		return s.client.findAll(ctx, bson.M{"endat": bson.M{"$gt": now}}, &ads)
+	})
 	if err != nil {
-		return []File{}, err
+		return []File{}, mongoError(err)
+	}
+	return ads, nil
+}
+
+// get the ads created today and the ads active now from db
+func (s *MongoStore) Usage(ctx context.Context) (Usage, error) {
+	now := s.clock.Now()
+	day := quotaDay(now)
+	created, err := s.client.DailyCount(ctx, day)
+	if err != nil {
+		return Usage{}, err
+	}
+	active, err := s.client.CountActiveRecords(ctx, now)
+	if err != nil {
+		return Usage{}, err
 	}
-	defer cursor.Close(context.Background())
+	return Usage{
+		Date:        day,
+		Created:     created,
+		DailyLimit:  s.quota.DailyLimit,
+		Active:      active,
+		ActiveLimit: s.quota.ActiveLimit,
+	}, nil
+}
 
-	// realize finding data
-	var results []File
-	if err := cursor.All(context.Background(), &results); err != nil {
-		return []File{}, nil
+// check mongodb is reachable
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx)
+}
+
+// set the filter of the query, an ad matches when it is active and one of its conditions satisfies every supplied dimension
+func queryFilter(query QueryRequest, now time.Time, zones []string) bson.M {
+	filter := bson.M{}
+	filter["startat"] = bson.M{"$lte": now}
+	filter["endat"] = bson.M{"$gt": now}
+	filter["$and"] = []bson.M{scheduleFilter(now, zones)}
+	if match := conditionFilter(query); match != nil {
+		filter["$or"] = []bson.M{
+			{"conditions": bson.M{"$elemMatch": match}},
+			// an ad without condition is not restricted at all
+			{"conditions": bson.M{"$size": 0}},
+			{"conditions": nil},
+		}
 	}
+	return filter
+}
 
-	// sort by end time
-	sort.Slice(results, func(i, j int) bool { return results[i].EndAt.Before(results[j].EndAt) })
+// set the filter of the schedule, the day and the hour of now are computed in go for each time zone of the active
+// ads, so mongodb never parses a time zone, and the zones at the same day and hour share a clause
+func scheduleFilter(now time.Time, zones []string) bson.M {
+	type dayHour struct {
+		day  string
+		hour int
+	}
+	groups := make(map[dayHour][]string)
+	for _, zone := range zones {
+		// a time zone which can not be loaded is never served, like inschedule
+		loc, err := loadTimeZone(zone)
+		if err != nil {
+			continue
+		}
+		local := now.In(loc)
+		key := dayHour{weekdays[local.Weekday()], local.Hour()}
+		groups[key] = append(groups[key], zone)
+	}
 
-	// check offset and limit
-	if query.Offset > len(results) {
-		return []File{}, errors.New("offset is out of index in the query results")
+	// an ad without schedule is served all the time, and empty days and hours are every day and all day
+	clauses := []bson.M{{"schedule": nil}}
+	for key, zones := range groups {
+		clauses = append(clauses, bson.M{
+			"schedule.timezone": bson.M{"$in": zones},
+			"$and": []bson.M{
+				{"$or": []bson.M{
+					{"schedule.days": nil},
+					{"schedule.days": bson.M{"$size": 0}},
+					{"schedule.days": key.day},
+				}},
+				{"$or": []bson.M{
+					{"schedule.hours": nil},
+					{"schedule.hours": bson.M{"$size": 0}},
+					{"schedule.hours": bson.M{"$elemMatch": bson.M{"start": bson.M{"$lte": key.hour}, "end": bson.M{"$gt": key.hour}}}},
+				}},
+			},
+		})
 	}
-	if query.Offset+query.Limit > len(results) {
-		results = results[query.Offset:]
-	} else {
-		results = results[query.Offset : query.Offset+query.Limit]
+	return bson.M{"$or": clauses}
+}
+
+// set the filter applied on a single condition, nil means the query is not restricted
+func conditionFilter(query QueryRequest) bson.M {
+	clauses := make([]bson.M, 0)
+	if query.Age != 0 {
+		clauses = append(clauses, ageFilter(query.Age))
 	}
-	return results, nil
+	if query.Gender != "" {
+		clauses = append(clauses, listFilter("gender", "excludegender", query.Gender))
+	}
+	if query.Country != "" {
+		clauses = append(clauses, listFilter("country", "excludecountry", query.Country))
+	}
+	if query.Platform != "" {
+		clauses = append(clauses, listFilter("platform", "excludeplatform", query.Platform))
+	}
+	if len(clauses) == 0 {
+		return nil
+	}
+	return bson.M{"$and": clauses}
 }
 
-// print the ad data get from client to log file
-func printLogPostRequest(ad AdData) {
-	log.Println("POST from:", ad.ClientIP)
-	log.Println("POST Headers:")
-	for key, vals := range ad.Headers {
-		log.Print("\t", key, ": ", vals, "\n")
+// set the filter of the age, the legacy age range is only checked when the condition has no ages
+func ageFilter(age int) bson.M {
+	return bson.M{"$or": []bson.M{
+		// $not matches an unset bound as well, so a nil bound is open
+		{"ages": bson.M{"$elemMatch": bson.M{
+			"min": bson.M{"$not": bson.M{"$gt": age}},
+			"max": bson.M{"$not": bson.M{"$lt": age}},
+		}}},
+		{"ages": bson.M{"$in": bson.A{nil, bson.A{}}}, "$or": []bson.M{
+			{"agestart": bson.M{"$lte": age}, "ageend": bson.M{"$gte": age}},
+			{"agestart": 0, "ageend": 0},
+		}},
+	}}
+}
+
+// set the filter of a list field, an unset or empty list is a wildcard, and the value should not be in the exclude list
+func listFilter(field, exclude, value string) bson.M {
+	return bson.M{
+		"$or": []bson.M{
+			{field: value},
+			{field: nil},
+			{field: bson.M{"$size": 0}},
+		},
+		// $ne on an array matches when no element is the value, an unset exclude list matches as well
+		exclude: bson.M{"$ne": value},
 	}
-	log.Println("POST Body:")
-	log.Print("\t", ad.Ad, "\n")
 }
 
-// print the query requirement from client to log file
-func printLogGetRequest(query QueryRequest) {
-	log.Println("GET from:", query.ClientIP)
-	log.Println("GET Headers:")
-	for key, vals := range query.Headers {
-		log.Print("\t", key, ": ", vals, "\n")
+// set the filter of the ads after the cursor in the endAt ordering
+func afterFilter(cursor Cursor) (bson.M, error) {
+	oid, err := primitive.ObjectIDFromHex(cursor.ID)
+	if err != nil {
+		return nil, ErrInvalidCursor
 	}
-	log.Println("GET Requirement:")
-	log.Println("\t", "offset:", query.Offset)
-	log.Println("\t", "limit:", query.Limit)
-	log.Println("\t", "age:", query.Age)
-	log.Println("\t", "gender:", query.Gender)
-	log.Println("\t", "country:", query.Country)
-	log.Println("\t", "platform:", query.Platform)
+	return bson.M{"$or": []bson.M{
+		{"endat": bson.M{"$gt": cursor.EndAt}},
+		{"endat": cursor.EndAt, "_id": bson.M{"$gt": oid}},
+	}}, nil
 }
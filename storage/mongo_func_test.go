@@ -1,1794 +1,284 @@
-package storage_test
+package storage
 
 import (
 	"context"
-	"errors"
-	"sort"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// set the ad struct from POST request and the real ad struct
-type Condition struct {
-	AgeStart int      `json:"agestart"`
-	AgeEnd   int      `json:"ageend"`
-	Gender   []string `json:"gender"`
-	Country  []string `json:"country"`
-	Platform []string `json:"platform"`
-}
-type File struct {
-	Title      string      `json:"title"`
-	StartAt    time.Time   `json:"startat"`
-	EndAt      time.Time   `json:"endat"`
-	Conditions []Condition `json:"conditions"`
-}
-type AdData struct {
-	ClientIP string
-	Headers  map[string][]string
-	Ad       File
-}
-
-// set the query struct from GET request
-type QueryRequest struct {
-	ClientIP string
-	Headers  map[string][]string
-	Offset   int
-	Limit    int
-	Age      int
-	Gender   string
-	Country  string
-	Platform string
-}
-
-// insert ad into mongodb
-func StoreData(ad AdData) error {
-	printLogPostRequest(ad)
-
-	// set mongodb connection
-	uri, database, collection, err := SetUri("test.conf")
-	if err != nil {
-		return err
-	}
-	mgoClient, err := NewMgoClient(uri, database, collection)
-	if err != nil {
-		return err
-	}
-	defer CloseMongoDB(mgoClient.client)
-
-	// insert
-	if err = mgoClient.InsertOneRecord(&ad.Ad); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// test storedata
-func TestStoreData(t *testing.T) {
-	test_file := &File{
-		Title:      "test AD",
-		StartAt:    time.Now(),
-		EndAt:      time.Now(),
-		Conditions: []Condition{},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set uri
-	uri, database, collection, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// create a test db
-	db := client.Database(database)
-	coll := db.Collection(collection)
-
-	// query to check if test ad is in db
-	var result File
-	err = coll.FindOne(context.Background(), bson.M{"title": test_ad.Ad.Title}).Decode(&result)
-	if err != nil {
-		t.Fatalf("Failed to find test ad in MongoDB: %v", err)
-	}
-	assert.Equal(t, test_ad.Ad.Title, result.Title)
-
-	// drop this db
-	err = db.Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-
-// query ad from db
-func QueryData(query QueryRequest) ([]File, error) {
-	printLogGetRequest(query)
-
-	// set mongodb connection
-	uri, database, collection, err := SetUri("test.conf")
-	if err != nil {
-		return []File{}, err
-	}
-	mgoClient, err := NewMgoClient(uri, database, collection)
-	if err != nil {
-		return []File{}, err
-	}
-	defer CloseMongoDB(mgoClient.client)
-
-	// set filter
-	filter := bson.M{}
-	filter["endat"] = bson.M{"$gt": time.Now()}
-	if query.Age != 0 {
-		filter["$or"] = []bson.M{
-			{"$and": []bson.M{
-				{"conditions.agestart": bson.M{"$lte": query.Age}},
-				{"conditions.ageend": bson.M{"$gte": query.Age}},
-			}},
-			{"$and": []bson.M{
-				{"conditions.agestart": 0},
-				{"conditions.ageend": 0},
-			}},
-		}
-	}
-	if query.Gender != "" {
-		filter["$or"] = []bson.M{
-			{"conditions.gender": query.Gender},
-			{"conditions.gender": nil},
-		}
-	}
-	if query.Country != "" {
-		filter["$or"] = []bson.M{
-			{"conditions.country": query.Country},
-			{"conditions.country": nil},
-		}
-	}
-	if query.Platform != "" {
-		filter["$or"] = []bson.M{
-			{"conditions.platform": query.Platform},
-			{"conditions.platform": nil},
-		}
-	}
-
-	// set filter to cursor
-	cursor, err := mgoClient.collection.Find(context.Background(), filter)
-	if err != nil {
-		return []File{}, err
-	}
-	defer cursor.Close(context.Background())
-
-	// realize finding data
-	var results []File
-	if err := cursor.All(context.Background(), &results); err != nil {
-		return []File{}, nil
-	}
-
-	// sort by end time
-	sort.Slice(results, func(i, j int) bool { return results[i].EndAt.Before(results[j].EndAt) })
-
-	// check offset and limit
-	if query.Offset > len(results) {
-		return []File{}, errors.New("offset is out of index in the query results")
-	}
-	if query.Offset+query.Limit > len(results) {
-		results = results[query.Offset:]
-	} else {
-		results = results[query.Offset : query.Offset+query.Limit]
-	}
-	return results, nil
-}
-
-// test query with offset
-func TestQuery_Offset(t *testing.T) {
-	test_file0 := &File{
-		Title:   "test AD0",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file1 := &File{
-		Title:   "test AD1",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file2 := &File{
-		Title:   "test AD2",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad0 := AdData{
-		Ad: *test_file0,
-	}
-	test_ad1 := AdData{
-		Ad: *test_file1,
-	}
-	test_ad2 := AdData{
-		Ad: *test_file2,
-	}
-
-	// insert three test ads
-	if err := StoreData(test_ad0); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad1); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad2); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   1,
-		Limit:    5,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in offset in query: %v", err)
-	}
-
-	assert.Equal(t, 2, len(result))
-	assert.Equal(t, test_ad1.Ad.Title, result[0].Title)
-	assert.Equal(t, test_ad2.Ad.Title, result[1].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-func TestQuery_Offset_TooMuch(t *testing.T) {
-	test_file0 := &File{
-		Title:   "test AD0",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file1 := &File{
-		Title:   "test AD1",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file2 := &File{
-		Title:   "test AD2",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad0 := AdData{
-		Ad: *test_file0,
-	}
-	test_ad1 := AdData{
-		Ad: *test_file1,
-	}
-	test_ad2 := AdData{
-		Ad: *test_file2,
-	}
-
-	// insert three test ads
-	if err := StoreData(test_ad0); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad1); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad2); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   4,
-		Limit:    5,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	_, err := QueryData(query)
-	if err == nil {
-		t.Fatalf("Failed with query in offset too much in query: %v", err)
-	}
-	assert.Equal(t, err, errors.New("offset is out of index in the query results"))
-	
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-
-// test query with limit
-func TestQuery_Limit(t *testing.T) {
-	test_file0 := &File{
-		Title:   "test AD0",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file1 := &File{
-		Title:   "test AD1",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file2 := &File{
-		Title:   "test AD2",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad0 := AdData{
-		Ad: *test_file0,
-	}
-	test_ad1 := AdData{
-		Ad: *test_file1,
-	}
-	test_ad2 := AdData{
-		Ad: *test_file2,
-	}
-
-	// insert three test ads
-	if err := StoreData(test_ad0); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad1); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad2); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   1,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in limit in query: %v", err)
-	}
-
-	assert.Equal(t, 1, len(result))
-	assert.Equal(t, test_ad1.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-
-// test the result is sort by end time
-func TestQuery_Sort(t *testing.T) {
-	test_file0 := &File{
-		Title:   "test AD0",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 3),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file1 := &File{
-		Title:   "test AD1",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 2),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_file2 := &File{
-		Title:   "test AD2",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad0 := AdData{
-		Ad: *test_file0,
-	}
-	test_ad1 := AdData{
-		Ad: *test_file1,
-	}
-	test_ad2 := AdData{
-		Ad: *test_file2,
-	}
-
-	// insert three test ads
-	if err := StoreData(test_ad0); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad1); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-	if err := StoreData(test_ad2); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    3,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in sort in query: %v", err)
-	}
-
-	assert.Equal(t, 3, len(result))
-	assert.Equal(t, test_ad2.Ad.Title, result[0].Title)
-	assert.Equal(t, test_ad1.Ad.Title, result[1].Title)
-	assert.Equal(t, test_ad0.Ad.Title, result[2].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-
-// test query with age
-func TestQueryData_Age_NoLimitInQuery(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 20,
-				AgeEnd:   30,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in age no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-func TestQueryData_Age_NoLimitInDB(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      50,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in age no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-func TestQueryData_Age_BeforeStart(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 20,
-				AgeEnd:   30,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      15,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in age before start in query: %v", err)
-	}
-
-	assert.Equal(t, 0, len(result))
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-func TestQueryData_Age_BetweenStartAndEnd(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 20,
-				AgeEnd:   30,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      25,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in age between in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-func TestQueryData_Age_AfterEnd(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 20,
-				AgeEnd:   30,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      35,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in age after end in query: %v", err)
-	}
-
-	assert.Equal(t, 0, len(result))
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-
-// test query with gender
-func TestQueryData_Gender_NoLimitInQuery(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   []string{"M", "F"},
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in gender no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
-}
-func TestQueryData_Gender_NoLimitInDB(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "F",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in gender no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
+// establish a mongodb store on the test database, the test is skipped when no mongod is running
+func newTestMongoStore(t testing.TB, opts ...Option) *MongoStore {
+	testClient, _, _ := connectTestMongo(t)
+	CloseMongoDB(testClient)
 
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	client, err := newTestMgoClient(t)
 	if err != nil {
 		t.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
 
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
+	// drop the test db and close the client after the test
+	t.Cleanup(func() {
+		if err := client.db.Drop(context.Background()); err != nil {
+			t.Errorf("Failed to drop test database: %v", err)
+		}
+		client.Close()
+	})
+	return NewMongoStore(client, opts...)
 }
-func TestQueryData_Gender_ConditionInTestData(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   []string{"M"},
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "M",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in gender in test in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
 
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
+// test the mongodb store shares one client between concurrent requests
+func TestMongoStore_SharedClient(t *testing.T) {
+	store := newTestMongoStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.Insert(context.Background(), File{
+				Title:   "test AD" + strconv.Itoa(i),
+				StartAt: time.Now(),
+				EndAt:   time.Now().AddDate(0, 0, 1),
+			})
+			assert.NoError(t, err)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := store.Query(context.Background(), QueryRequest{Offset: 0, Limit: 100})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	result, err := store.Query(context.Background(), QueryRequest{Offset: 0, Limit: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 20, len(result))
 }
-func TestQueryData_Gender_ConditionNotInTestData(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   []string{"M"},
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "F",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in gender not in test in query: %v", err)
-	}
 
-	assert.Equal(t, 0, len(result))
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
+// test the mongodb store sorts and pages in the database
+func TestMongoStore_Pagination(t *testing.T) {
+	store := newTestMongoStore(t)
+
+	// insert the ads in the reverse order of their end time
+	now := time.Now()
+	for i := 9; i >= 0; i-- {
+		_, err := store.Insert(context.Background(), File{
+			Title:   "test AD" + strconv.Itoa(i),
+			StartAt: now,
+			EndAt:   now.Add(time.Duration(i+1) * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("Fail to store test ad: %v", err)
+		}
 	}
 
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
+	// the page is sorted by end time
+	results, err := store.Query(context.Background(), QueryRequest{Offset: 3, Limit: 4})
+	assert.NoError(t, err)
+	if assert.Equal(t, 4, len(results)) {
+		for i, result := range results {
+			assert.Equal(t, "test AD"+strconv.Itoa(i+3), result.Title)
+		}
 	}
 
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
+	// the offset can reach the end of the results, but not beyond it
+	results, err = store.Query(context.Background(), QueryRequest{Offset: 10, Limit: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(results))
+	_, err = store.Query(context.Background(), QueryRequest{Offset: 11, Limit: 4})
+	assert.Equal(t, ErrOffsetOutOfRange, err)
 }
 
-// test query with country
-func TestQueryData_Country_NoLimtInQuery(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  []string{"TW", "JP"},
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in country no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
+// insert the ads used by the query benchmarks
+func seedBenchmarkAds(b *testing.B, store *MongoStore, n int) {
+	if err := store.client.EnsureIndexes(context.Background()); err != nil {
+		b.Fatalf("Failed to create indexes: %v", err)
+	}
+	now := time.Now()
+	countries := []string{"TW", "JP", "US", "KR"}
+	platforms := []string{"android", "ios", "web"}
+	ads := make([]interface{}, n)
+	for i := range ads {
+		ads[i] = File{
+			Title:   "bench AD" + strconv.Itoa(i),
+			StartAt: now.Add(-time.Hour),
+			EndAt:   now.Add(time.Duration(i%1000+1) * time.Minute),
+			Conditions: []Condition{{
+				AgeStart: 20,
+				AgeEnd:   40,
+				Country:  []string{countries[i%len(countries)]},
+				Platform: []string{platforms[i%len(platforms)]},
+			}},
+		}
 	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
+	if _, err := store.client.collection.InsertMany(context.Background(), ads); err != nil {
+		b.Fatalf("Failed to insert bench ads: %v", err)
 	}
 }
-func TestQueryData_Country_NoLimtInDB(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "TW",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in country no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
 
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
+// the benchmark query, a page in the middle of the results
+var benchmarkQuery = QueryRequest{Offset: 50, Limit: 10, Age: 30, Country: "TW", Platform: "ios"}
 
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
+// benchmark the old query, which loads every matching ad, sorts them in go and slices a page
+func BenchmarkQuery_SortInGo(b *testing.B) {
+	store := newTestMongoStore(b)
+	seedBenchmarkAds(b, store, 5000)
+	filter := queryFilter(benchmarkQuery, time.Now(), nil)
 
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cursor, err := store.client.collection.Find(context.Background(), filter)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var results []File
+		if err := cursor.All(context.Background(), &results); err != nil {
+			b.Fatal(err)
+		}
+		sortByEndAt(results)
+		if _, err := paginate(results, benchmarkQuery.Offset, benchmarkQuery.Limit); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
-func TestQueryData_Country_ConditionInTestData(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  []string{"TW", "JP"},
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "TW",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in country in test in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
 
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
+// benchmark the query, which sorts, skips and limits in mongodb
+func BenchmarkQuery_SortInDB(b *testing.B) {
+	store := newTestMongoStore(b)
+	seedBenchmarkAds(b, store, 5000)
 
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Query(context.Background(), benchmarkQuery); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
-func TestQueryData_Country_ConditionNotInTestData(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  []string{"TW", "JP"},
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "USA",
-		Platform: "",
-	}
 
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in country not in test in query: %v", err)
-	}
-
-	assert.Equal(t, 0, len(result))
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
+// test the mongodb store pages with a cursor
+func TestMongoStore_Cursor(t *testing.T) {
+	store := newTestMongoStore(t)
 
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
+	// insert ads sharing the same end time, so the id breaks the tie
+	endAt := time.Now().Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		_, err := store.Insert(context.Background(), File{Title: "test AD" + strconv.Itoa(i), StartAt: time.Now(), EndAt: endAt})
+		if err != nil {
+			t.Fatalf("Fail to store test ad: %v", err)
+		}
 	}
 
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
+	first, err := store.Query(context.Background(), QueryRequest{Limit: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(first))
 
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
+	after := CursorOf(first[2])
+	second, err := store.Query(context.Background(), QueryRequest{Limit: 3, After: &after})
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(second)) {
+		assert.Equal(t, "test AD3", second[0].Title)
+		assert.Equal(t, "test AD4", second[1].Title)
 	}
 }
 
-// test query with platform
-func TestQueryData_Platform_NoLimtInQuery(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: []string{"ios"},
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in platform no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
+// run the test of a patch checked against a base which another request changed since
+func runPatchBaseTest(t *testing.T, store AdStore) {
+	start := time.Now().Truncate(time.Millisecond)
+	id, err := store.Insert(context.Background(), File{Title: "test AD", StartAt: start, EndAt: start.Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	base, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+
+	// a patch on the ad it was checked against is written
+	title := "test AD patched"
+	patched, err := store.Patch(context.Background(), id, AdPatch{Title: &title, Base: &base})
+	assert.NoError(t, err)
+	assert.Equal(t, title, patched.Title)
+
+	// another request moves startAt, so a patch moving endAt checked against the old range is refused
+	startAt := start.Add(time.Hour)
+	_, err = store.Patch(context.Background(), id, AdPatch{StartAt: &startAt, Base: &base})
+	assert.NoError(t, err)
+	endAt := start.Add(30 * time.Minute)
+	_, err = store.Patch(context.Background(), id, AdPatch{EndAt: &endAt, Base: &base})
+	assert.Equal(t, ErrAdChanged, err)
+
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.True(t, ad.StartAt.Before(ad.EndAt))
+
+	// a deleted ad is still not found
+	assert.NoError(t, store.Delete(context.Background(), id))
+	_, err = store.Patch(context.Background(), id, AdPatch{Title: &title, Base: &base})
+	assert.Equal(t, ErrNotFound, err)
 }
-func TestQueryData_Platform_NoLimtInDB(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: nil,
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "ios",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in platform no limit in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
 
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
+// test the in-memory store refuses a patch on a changed ad
+func TestMemoryStore_PatchBase(t *testing.T) {
+	runPatchBaseTest(t, NewMemoryStore())
 }
-func TestQueryData_Platform_ConditionInTestData(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: []string{"ios", "MacOS"},
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "MacOS",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in platform in test in query: %v", err)
-	}
-
-	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
 
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
-
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
-	}
-
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
-	}
+// test the mongodb store refuses a patch on a changed ad
+func TestMongoStore_PatchBase(t *testing.T) {
+	runPatchBaseTest(t, newTestMongoStore(t))
 }
-func TestQueryData_Platform_ConditionNotInTestData(t *testing.T) {
-	test_file := &File{
-		Title:   "test AD",
-		StartAt: time.Now(),
-		EndAt:   time.Now().AddDate(0, 0, 1),
-		Conditions: []Condition{
-			{
-				AgeStart: 0,
-				AgeEnd:   0,
-				Gender:   nil,
-				Country:  nil,
-				Platform: []string{"ios"},
-			},
-		},
-	}
-	test_ad := AdData{
-		Ad: *test_file,
-	}
-
-	// insert a test ad
-	if err := StoreData(test_ad); err != nil {
-		t.Fatalf("Fail to store test ad to MongoDB: %v", err)
-	}
-
-	// set query condition
-	query := QueryRequest{
-		ClientIP: "",
-		Headers:  nil,
-		Offset:   0,
-		Limit:    1,
-		Age:      0,
-		Gender:   "",
-		Country:  "",
-		Platform: "MacOS",
-	}
-
-	// go to query
-	result, err := QueryData(query)
-	if err != nil {
-		t.Fatalf("Failed with query in platform not in test in query: %v", err)
-	}
-
-	assert.Equal(t, 0, len(result))
-
-	// set uri
-	uri, database, _, err := SetUri("test.conf")
-	if err != nil {
-		t.Fatalf("SetUri returned an error: %v", err)
-	}
 
-	// establish a test client
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
-	if err != nil {
-		t.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	// drop this db
-	err = client.Database(database).Drop(context.Background())
-	if err != nil {
-		t.Fatalf("Failed to drop test database: %v", err)
+// run the test of the ads whose local day is not the day in utc, the fake clock starts at friday 17:00 in utc
+func runLocalDayTest(t *testing.T, store AdStore, clock *fakeClock) {
+	for _, ad := range []File{
+		// saturday 01:00 in taipei
+		{Title: "saturdays in taipei", Schedule: &Schedule{TimeZone: "Asia/Taipei", Days: []string{"sat"}, Hours: []HourRange{{Start: 0, End: 2}}}},
+		// friday 10:00 in los angeles
+		{Title: "fridays in los angeles", Schedule: &Schedule{TimeZone: "America/Los_Angeles", Days: []string{"fri"}}},
+		{Title: "fridays in taipei", Schedule: &Schedule{TimeZone: "Asia/Taipei", Days: []string{"fri"}}},
+	} {
+		ad.StartAt = clock.Now().Add(-time.Hour)
+		ad.EndAt = clock.Now().AddDate(0, 0, 30)
+		if _, err := store.Insert(context.Background(), ad); err != nil {
+			t.Fatalf("Fail to store test ad: %v", err)
+		}
 	}
 
-	// defer to close it
-	if err := client.Disconnect(context.TODO()); err != nil {
-		t.Fatalf("Failes to disconnect the client: %v", err)
+	steps := []struct {
+		advance time.Duration
+		want    []string
+	}{
+		{0, []string{"saturdays in taipei", "fridays in los angeles"}},
+		// saturday 03:00 in taipei and friday 12:00 in los angeles
+		{2 * time.Hour, []string{"fridays in los angeles"}},
+		// saturday 15:00 in taipei and saturday 00:00 in los angeles
+		{12 * time.Hour, []string{}},
+		// friday 01:00 in taipei and thursday 10:00 in los angeles of the next week
+		{5*24*time.Hour + 10*time.Hour, []string{"fridays in taipei"}},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		results, err := store.Query(context.Background(), QueryRequest{Limit: 5})
+		if err != nil {
+			t.Fatalf("Failed with query: %v", err)
+		}
+		titles := make([]string, len(results))
+		for i, result := range results {
+			titles[i] = result.Title
+		}
+		assert.ElementsMatch(t, step.want, titles, clock.Now().String())
 	}
 }
 
-// print the ad data get from client to log file
-func printLogPostRequest(ad AdData) {
+// test the in-memory store serves the ads on their local day
+func TestMemoryStore_LocalDay(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 6, 21, 17, 0, 0, 0, time.UTC))
+	runLocalDayTest(t, NewMemoryStore(WithClock(clock)), clock)
 }
 
-// print the query requirement from client to log file
-func printLogGetRequest(query QueryRequest) {
+// test the mongodb store serves the ads on their local day
+func TestMongoStore_LocalDay(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 6, 21, 17, 0, 0, 0, time.UTC))
+	runLocalDayTest(t, newTestMongoStore(t, WithClock(clock)), clock)
 }
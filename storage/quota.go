@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"dcard/apperr"
+)
+
+// define the limits on creating ads, a zero limit is not enforced
+type Quota struct {
+	// the number of ads which can be created in a day (utc)
+	DailyLimit int
+	// the number of ads which can be active at the same moment
+	ActiveLimit int
+}
+
+// the product contract, at most 3000 ads created per day and 1000 ads active at any moment
+var DefaultQuota = Quota{DailyLimit: 3000, ActiveLimit: 1000}
+
+// define the current usage of the quota
+type Usage struct {
+	Date        string `json:"date"`
+	Created     int    `json:"created"`
+	DailyLimit  int    `json:"dailyLimit"`
+	Active      int    `json:"active"`
+	ActiveLimit int    `json:"activeLimit"`
+}
+
+// enforce the given limits when an ad is inserted
+func WithQuota(quota Quota) Option {
+	return func(o *storeOptions) {
+		o.quota = quota
+	}
+}
+
+// the day an ad created at the given time counts against
+func quotaDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// the error returned when the ads created today have reached the daily limit
+func errDailyQuotaExceeded(limit, created int) error {
+	return apperr.New(apperr.TooManyRequests, "daily_quota_exceeded", fmt.Sprintf("at most %d ads can be created per day", limit)).
+		WithDetails(map[string]any{"limit": limit, "created": created})
+}
+
+// the error returned when the ad would make more ads active at the same moment than the limit
+func errActiveCapExceeded(limit, active int) error {
+	return apperr.New(apperr.Conflict, "active_cap_exceeded", fmt.Sprintf("at most %d ads can be active at the same time", limit)).
+		WithDetails(map[string]any{"limit": limit, "active": active})
+}
+
+// check if two versions of an ad have the same time range, only a changed range is checked against the active cap
+func sameTimeRange(ad, other File) bool {
+	return ad.StartAt.Equal(other.StartAt) && ad.EndAt.Equal(other.EndAt)
+}
+
+// count the most ads active at the same moment during [startAt, endAt)
+func maxOverlap(ads []File, startAt, endAt time.Time) int {
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	events := make([]event, 0, 2*len(ads))
+	for _, ad := range ads {
+		// only the part of the flight inside the window matters
+		from, to := ad.StartAt, ad.EndAt
+		if from.Before(startAt) {
+			from = startAt
+		}
+		if to.After(endAt) {
+			to = endAt
+		}
+		if from.Before(to) {
+			events = append(events, event{from, 1}, event{to, -1})
+		}
+	}
+
+	// an ad is no longer active at its endAt, so an end goes before a start at the same moment
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].at.Equal(events[j].at) {
+			return events[i].at.Before(events[j].at)
+		}
+		return events[i].delta < events[j].delta
+	})
+
+	active, peak := 0, 0
+	for _, e := range events {
+		active += e.delta
+		if active > peak {
+			peak = active
+		}
+	}
+	return peak
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"dcard/apperr"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// test maxoverlap counts the peak of the ads active at the same moment inside the window
+func TestMaxOverlap(t *testing.T) {
+	base := time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time { return base.Add(time.Duration(hour) * time.Hour) }
+	ads := []File{
+		{StartAt: at(0), EndAt: at(4)},
+		{StartAt: at(1), EndAt: at(3)},
+		{StartAt: at(2), EndAt: at(6)},
+		// it starts when the second one ends, so they are never active together
+		{StartAt: at(3), EndAt: at(5)},
+		{StartAt: at(8), EndAt: at(9)},
+	}
+
+	assert.Equal(t, 3, maxOverlap(ads, at(0), at(10)))
+	assert.Equal(t, 3, maxOverlap(ads, at(3), at(4)))
+	assert.Equal(t, 2, maxOverlap(ads, at(4), at(8)))
+	assert.Equal(t, 1, maxOverlap(ads, at(0), at(1)))
+	assert.Equal(t, 0, maxOverlap(ads, at(6), at(8)))
+	assert.Equal(t, 0, maxOverlap(nil, at(0), at(10)))
+}
+
+// test quotaday uses the utc date
+func TestQuotaDay(t *testing.T) {
+	taipei := time.FixedZone("Asia/Taipei", 8*60*60)
+	assert.Equal(t, "2024-01-20", quotaDay(time.Date(2024, 1, 21, 7, 59, 0, 0, taipei)))
+	assert.Equal(t, "2024-01-21", quotaDay(time.Date(2024, 1, 21, 8, 0, 0, 0, taipei)))
+}
+
+// run the quota test against a store limited to 3 ads per day and 2 active ads
+func runQuotaTest(t *testing.T, store AdStore, clock *fakeClock) {
+	now := clock.Now()
+	insert := func(from, to int) error {
+		_, err := store.Insert(context.Background(), File{
+			Title:   "test AD",
+			StartAt: now.Add(time.Duration(from) * time.Hour),
+			EndAt:   now.Add(time.Duration(to) * time.Hour),
+		})
+		return err
+	}
+
+	// the active cap is about the same moment, not the same day
+	assert.NoError(t, insert(0, 2))
+	assert.NoError(t, insert(1, 3))
+	err := insert(0, 4)
+	assert.Equal(t, apperr.Conflict, apperr.From(err).Kind)
+	assert.Equal(t, "active_cap_exceeded", apperr.From(err).Code)
+	assert.Equal(t, map[string]any{"limit": 2, "active": 2}, apperr.From(err).Details)
+
+	// a rejected ad does not use the daily quota
+	assert.NoError(t, insert(3, 4))
+	err = insert(5, 6)
+	assert.Equal(t, apperr.TooManyRequests, apperr.From(err).Kind)
+	assert.Equal(t, map[string]any{"limit": 3, "created": 3}, apperr.From(err).Details)
+
+	usage, err := store.Usage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{Date: quotaDay(now), Created: 3, DailyLimit: 3, Active: 1, ActiveLimit: 2}, usage)
+
+	// the daily quota is reset the next day
+	clock.Advance(24 * time.Hour)
+	assert.NoError(t, insert(24, 25))
+	usage, err = store.Usage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usage.Created)
+}
+
+// test the in-memory store enforces the quota
+func TestMemoryStore_Quota(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	store := NewMemoryStore(WithClock(clock), WithQuota(Quota{DailyLimit: 3, ActiveLimit: 2}))
+	runQuotaTest(t, store, clock)
+}
+
+// test the mongodb store enforces the quota
+func TestMongoStore_Quota(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	store := newTestMongoStore(t, WithClock(clock), WithQuota(Quota{DailyLimit: 3, ActiveLimit: 2}))
+	runQuotaTest(t, store, clock)
+}
+
+// run the test of the active cap on a put and a patch moving the time range, against a store limited to 1 active ad
+func runQuotaMoveTest(t *testing.T, store AdStore, clock *fakeClock) {
+	now := clock.Now()
+	active := File{Title: "active AD", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour)}
+	if _, err := store.Insert(context.Background(), active); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	future := File{Title: "future AD", StartAt: now.Add(2 * time.Hour), EndAt: now.Add(3 * time.Hour)}
+	id, err := store.Insert(context.Background(), future)
+	if err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// a patch moving startAt to now is refused and nothing is changed
+	title := "future AD moved"
+	startAt := now
+	_, err = store.Patch(context.Background(), id, AdPatch{Title: &title, StartAt: &startAt})
+	assert.Equal(t, "active_cap_exceeded", apperr.From(err).Code)
+	assert.Equal(t, map[string]any{"limit": 1, "active": 1}, apperr.From(err).Details)
+
+	// a put moving the ad over the active one is refused as well
+	moved := future
+	moved.Title = title
+	moved.StartAt = now
+	err = store.Update(context.Background(), id, moved)
+	assert.Equal(t, apperr.Conflict, apperr.From(err).Kind)
+	assert.Equal(t, "active_cap_exceeded", apperr.From(err).Code)
+
+	ad, err := store.Get(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "future AD", ad.Title)
+	assert.True(t, ad.StartAt.Equal(future.StartAt))
+	usage, err := store.Usage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usage.Active)
+
+	// the ad is left out of its own count, so it can be moved inside the free window or renamed
+	endAt := now.Add(4 * time.Hour)
+	_, err = store.Patch(context.Background(), id, AdPatch{EndAt: &endAt})
+	assert.NoError(t, err)
+	moved.StartAt = now.Add(time.Hour)
+	moved.EndAt = endAt
+	assert.NoError(t, store.Update(context.Background(), id, moved))
+}
+
+// test the in-memory store checks the active cap when the time range is moved
+func TestMemoryStore_QuotaMove(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	runQuotaMoveTest(t, NewMemoryStore(WithClock(clock), WithQuota(Quota{ActiveLimit: 1})), clock)
+}
+
+// test the mongodb store checks the active cap when the time range is moved and undoes the write
+func TestMongoStore_QuotaMove(t *testing.T) {
+	clock := newFakeClock(time.Now().Truncate(time.Millisecond))
+	runQuotaMoveTest(t, newTestMongoStore(t, WithClock(clock), WithQuota(Quota{ActiveLimit: 1})), clock)
+}
+
+// test concurrent inserts never pass the limits together
+func runConcurrentQuotaTest(t *testing.T, store AdStore) {
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Insert(context.Background(), File{
+				Title:   "test AD" + strconv.Itoa(i),
+				StartAt: time.Now().Add(-time.Hour),
+				EndAt:   time.Now().Add(time.Hour),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	usage, err := store.Usage(context.Background())
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, usage.Created, 10)
+	assert.LessOrEqual(t, usage.Active, 5)
+}
+
+// test the in-memory store enforces the quota under concurrent inserts
+func TestMemoryStore_ConcurrentQuota(t *testing.T) {
+	runConcurrentQuotaTest(t, NewMemoryStore(WithQuota(Quota{DailyLimit: 10, ActiveLimit: 5})))
+}
+
+// test the mongodb store enforces the quota under concurrent inserts
+func TestMongoStore_ConcurrentQuota(t *testing.T) {
+	runConcurrentQuotaTest(t, newTestMongoStore(t, WithQuota(Quota{DailyLimit: 10, ActiveLimit: 5})))
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"dcard/metrics"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// define how an idempotent operation on mongodb is retried after a transient error, 0 or 1 attempt never retries
+type RetryOptions struct {
+	// the attempts including the first one
+	Attempts int
+	// the backoff before the n-th retry is a random duration up to BaseDelay * 2^(n-1), and never more than MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// the codes of the server errors seen while a replica set elects a primary or a mongod restarts
+var transientCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// check if the error is transient, so the operation may succeed when it is sent again
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || errors.As(err, &topology.ServerSelectionError{}) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+		for _, code := range transientCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the jittered backoff before the given retry, starting from 1
+func (r RetryOptions) backoff(retry int) time.Duration {
+	delay := r.BaseDelay << (retry - 1)
+	if delay <= 0 || (r.MaxDelay > 0 && delay > r.MaxDelay) {
+		delay = r.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return rand.N(delay + 1)
+}
+
+// run the operation on mongodb through the circuit breaker, an idempotent one is retried on a transient error until
+// the attempts are used up or the context ends, the error of the last attempt is returned as it is from the driver
+func (c *MgoClient) do(ctx context.Context, idempotent bool, op func(ctx context.Context) error) error {
+	attempts := 1
+	if idempotent && c.retry.Attempts > 1 {
+		attempts = c.retry.Attempts
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			metrics.MongoRetries.Inc()
+			timer := time.NewTimer(c.retry.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		if err := c.breaker.allow(); err != nil {
+			return err
+		}
+		err = op(ctx)
+		c.breaker.record(err)
+		if !isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"dcard/apperr"
+	"dcard/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// test the errors of a mongod restart or an election are transient, and the others are not
+func TestIsTransient(t *testing.T) {
+	transient := []error{
+		topology.ServerSelectionError{Wrapped: errors.New("connection refused")},
+		mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"},
+		mongo.CommandError{Code: 91, Name: "ShutdownInProgress"},
+		mongo.CommandError{Code: 1, Labels: []string{"RetryableWriteError"}},
+	}
+	for _, err := range transient {
+		assert.True(t, isTransient(err), err.Error())
+		assert.Equal(t, apperr.Unavailable, apperr.From(mongoError(err)).Kind, err.Error())
+	}
+
+	permanent := []error{
+		nil,
+		mongo.ErrNoDocuments,
+		mongo.CommandError{Code: 2, Name: "BadValue"},
+		mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key error"}}},
+		context.DeadlineExceeded,
+		context.Canceled,
+	}
+	for _, err := range permanent {
+		assert.False(t, isTransient(err), err)
+	}
+}
+
+// test the backoff is jittered below the doubling delay and capped
+func TestRetryOptions_Backoff(t *testing.T) {
+	retry := RetryOptions{Attempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 30 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, retry.backoff(1), 10*time.Millisecond)
+		assert.LessOrEqual(t, retry.backoff(2), 20*time.Millisecond)
+		assert.LessOrEqual(t, retry.backoff(3), 30*time.Millisecond)
+		assert.LessOrEqual(t, retry.backoff(60), 30*time.Millisecond)
+		assert.GreaterOrEqual(t, retry.backoff(60), time.Duration(0))
+	}
+	assert.Equal(t, time.Duration(0), RetryOptions{}.backoff(1))
+}
+
+// test an idempotent operation is retried on a transient error until it succeeds or the attempts are used up,
+// while the other operations and errors are not retried
+func TestMgoClient_Do(t *testing.T) {
+	client := &MgoClient{retry: RetryOptions{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}}
+	down := topology.ServerSelectionError{Wrapped: errors.New("connection refused")}
+
+	// fail the first calls with the error and succeed after them
+	failing := func(failures int, err error) (func(context.Context) error, *int) {
+		calls := 0
+		return func(context.Context) error {
+			calls++
+			if calls <= failures {
+				return err
+			}
+			return nil
+		}, &calls
+	}
+
+	retries := testutil.ToFloat64(metrics.MongoRetries)
+	op, calls := failing(2, down)
+	assert.NoError(t, client.do(context.Background(), true, op))
+	assert.Equal(t, 3, *calls)
+	assert.Equal(t, retries+2, testutil.ToFloat64(metrics.MongoRetries))
+
+	op, calls = failing(3, down)
+	assert.Equal(t, down, client.do(context.Background(), true, op))
+	assert.Equal(t, 3, *calls)
+
+	// an insert is sent once, and so is an operation failing for good
+	op, calls = failing(1, down)
+	assert.Equal(t, down, client.do(context.Background(), false, op))
+	assert.Equal(t, 1, *calls)
+	op, calls = failing(1, mongo.ErrNoDocuments)
+	assert.ErrorIs(t, client.do(context.Background(), true, op), mongo.ErrNoDocuments)
+	assert.Equal(t, 1, *calls)
+
+	// the backoff ends with the context
+	client.retry = RetryOptions{Attempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	op, calls = failing(3, down)
+	start := time.Now()
+	assert.Equal(t, down, client.do(ctx, true, op))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, *calls)
+}
+
+// test the operations fail fast without reaching mongodb while the breaker is open
+func TestMgoClient_DoBreaker(t *testing.T) {
+	b, clock := newTestBreaker(2, 10*time.Second)
+	client := &MgoClient{retry: RetryOptions{Attempts: 5}, breaker: b}
+	calls := 0
+	down := func(context.Context) error {
+		calls++
+		return topology.ServerSelectionError{Wrapped: errors.New("connection refused")}
+	}
+
+	// the retries stop once the breaker opens
+	err := client.do(context.Background(), true, down)
+	assert.ErrorIs(t, err, errCircuitOpen)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "store_circuit_open", apperr.From(mongoError(err)).Code)
+
+	assert.ErrorIs(t, client.do(context.Background(), true, down), errCircuitOpen)
+	assert.Equal(t, 2, calls)
+
+	// mongodb is back after the cooldown
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, client.do(context.Background(), true, func(context.Context) error { return nil }))
+	assert.NoError(t, client.do(context.Background(), true, func(context.Context) error { return nil }))
+}
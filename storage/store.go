@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"dcard/apperr"
+	"dcard/logging"
+	"dcard/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// set the ad struct from POST request and the real ad struct
+type Condition struct {
+	// the legacy age range, 0 and 0 means any age, it is only checked when ages is empty
+	AgeStart int `json:"ageStart"`
+	AgeEnd   int `json:"ageEnd"`
+	// the disjoint age ranges, the query age should be in one of them
+	Ages     []AgeRange `json:"ages,omitempty"`
+	Gender   []string   `json:"gender"`
+	Country  []string   `json:"country"`
+	Platform []string   `json:"platform"`
+	// the values excluded from the ad, a query with one of them never matches the condition
+	ExcludeGender   []string `json:"excludeGender,omitempty"`
+	ExcludeCountry  []string `json:"excludeCountry,omitempty"`
+	ExcludePlatform []string `json:"excludePlatform,omitempty"`
+}
+
+// set an age range of a condition, a nil bound is open
+type AgeRange struct {
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+}
+
+// set the weekly schedule of an ad, the ad is only served on the days and in the hours of its time zone
+type Schedule struct {
+	// the iana time zone of the days and the hours, like Asia/Taipei
+	TimeZone string `json:"timeZone"`
+	// the days of week from sun to sat, empty means every day
+	Days []string `json:"days,omitempty"`
+	// the hour ranges of a day, empty means all day
+	Hours []HourRange `json:"hours,omitempty"`
+}
+
+// set the hours of a day from start until end, so 18 and 23 is from 18:00 to 22:59
+type HourRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+type File struct {
+	ID         string      `json:"id,omitempty" bson:"_id,omitempty"`
+	Title      string      `json:"title"`
+	StartAt    time.Time   `json:"startAt"`
+	EndAt      time.Time   `json:"endAt"`
+	Conditions []Condition `json:"conditions"`
+	// the ad is served all the time between startAt and endAt without a schedule
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// set the fields of an ad to change from PATCH request, a nil field is kept as it is
+type AdPatch struct {
+	Title      *string       `json:"title"`
+	StartAt    *time.Time    `json:"startAt"`
+	EndAt      *time.Time    `json:"endAt"`
+	Conditions *[]Condition  `json:"conditions"`
+	Schedule   SchedulePatch `json:"schedule"`
+	// the ad the patch was checked against, the patch fails with ErrAdChanged when its time range was changed since
+	Base *File `json:"-"`
+}
+
+// set the schedule of a patch, a missing field keeps the schedule and null removes it
+type SchedulePatch struct {
+	Set      bool
+	Schedule *Schedule
+}
+
+// mark the schedule as set, it is only called when the field is in the body
+func (p *SchedulePatch) UnmarshalJSON(data []byte) error {
+	p.Set = true
+	return json.Unmarshal(data, &p.Schedule)
+}
+
+type AdData struct {
+	ClientIP string
+	Headers  map[string][]string
+	Ad       File
+}
+
+// set the query struct from GET request
+type QueryRequest struct {
+	ClientIP string
+	Headers  map[string][]string
+	Offset   int
+	Limit    int
+	After    *Cursor
+	Age      int
+	Gender   string
+	Country  string
+	Platform string
+}
+
+// the error returned when no ad has the requested id
+var ErrNotFound = apperr.New(apperr.NotFound, "ad_not_found", "ad not found")
+
+// the error returned when the ad was changed by another request after it was read for a patch
+var ErrAdChanged = apperr.New(apperr.Conflict, "ad_changed", "the ad was changed by another request, read it and try again")
+
+// the error returned when the offset is larger than the number of results
+var ErrOffsetOutOfRange = apperr.NewValidation("offset", "offset_out_of_range", "offset is out of index in the query results")
+
+// define the backend used to store and query the ads, the context carries the span of the request
+type AdStore interface {
+	// insert an ad and return its generated id
+	Insert(ctx context.Context, ad File) (string, error)
+	// query the active ads matching the requirement
+	Query(ctx context.Context, query QueryRequest) ([]File, error)
+	// get a single ad by its id
+	Get(ctx context.Context, id string) (File, error)
+	// replace the ad with the given id
+	Update(ctx context.Context, id string, ad File) error
+	// change some fields of the ad with the given id and return the changed ad
+	Patch(ctx context.Context, id string, patch AdPatch) (File, error)
+	// delete the ad with the given id
+	Delete(ctx context.Context, id string) error
+	// get the current usage of the quota
+	Usage(ctx context.Context) (Usage, error)
+	// check the store can serve the requests
+	Ping(ctx context.Context) error
+}
+
+// check if the stored ad still has the time range of the base of the patch, the range is the only rule across the fields
+func (p AdPatch) matchBase(ad File) bool {
+	return p.Base == nil || (ad.StartAt.Equal(p.Base.StartAt) && ad.EndAt.Equal(p.Base.EndAt))
+}
+
+// apply the patch on the ad
+func (p AdPatch) Apply(ad File) File {
+	if p.Title != nil {
+		ad.Title = *p.Title
+	}
+	if p.StartAt != nil {
+		ad.StartAt = *p.StartAt
+	}
+	if p.EndAt != nil {
+		ad.EndAt = *p.EndAt
+	}
+	if p.Conditions != nil {
+		ad.Conditions = *p.Conditions
+	}
+	if p.Schedule.Set {
+		ad.Schedule = p.Schedule.Schedule
+	}
+	return ad
+}
+
+// insert ad into the store, every helper below runs in a span of its own under the span of the request
+func StoreData(ctx context.Context, store AdStore, ad AdData) (id string, err error) {
+	ctx, span := tracing.Start(ctx, "StoreData", attribute.String("ad.title", ad.Ad.Title))
+	defer func() { tracing.End(span, err) }()
+
+	printLogPostRequest(logging.FromContext(ctx), "POST ad", ad)
+	id, err = store.Insert(ctx, ad.Ad)
+	span.SetAttributes(attribute.String("ad.id", id))
+	return id, err
+}
+
+// query ad from the store
+func QueryData(ctx context.Context, store AdStore, query QueryRequest) (results []File, err error) {
+	ctx, span := tracing.Start(ctx, "QueryData",
+		attribute.Int("query.offset", query.Offset),
+		attribute.Int("query.limit", query.Limit),
+		attribute.Bool("query.cursor", query.After != nil),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	printLogGetRequest(logging.FromContext(ctx), query)
+	results, err = store.Query(ctx, query)
+	span.SetAttributes(attribute.Int("ads.count", len(results)))
+	return results, err
+}
+
+// get a single ad from the store
+func GetData(ctx context.Context, store AdStore, id string) (ad File, err error) {
+	ctx, span := tracing.Start(ctx, "GetData", attribute.String("ad.id", id))
+	defer func() { tracing.End(span, err) }()
+
+	logging.FromContext(ctx).Info("GET ad", "id", id)
+	return store.Get(ctx, id)
+}
+
+// replace an ad in the store
+func UpdateData(ctx context.Context, store AdStore, id string, ad AdData) (err error) {
+	ctx, span := tracing.Start(ctx, "UpdateData", attribute.String("ad.id", id))
+	defer func() { tracing.End(span, err) }()
+
+	printLogPostRequest(logging.FromContext(ctx).With("id", id), "PUT ad", ad)
+	return store.Update(ctx, id, ad.Ad)
+}
+
+// change some fields of an ad in the store
+func PatchData(ctx context.Context, store AdStore, id string, patch AdPatch) (ad File, err error) {
+	ctx, span := tracing.Start(ctx, "PatchData", attribute.String("ad.id", id))
+	defer func() { tracing.End(span, err) }()
+
+	logging.FromContext(ctx).Info("PATCH ad", "id", id)
+	return store.Patch(ctx, id, patch)
+}
+
+// delete an ad from the store
+func DeleteData(ctx context.Context, store AdStore, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "DeleteData", attribute.String("ad.id", id))
+	defer func() { tracing.End(span, err) }()
+
+	logging.FromContext(ctx).Info("DELETE ad", "id", id)
+	return store.Delete(ctx, id)
+}
+
+// get the current usage of the quota from the store
+func UsageData(ctx context.Context, store AdStore) (usage Usage, err error) {
+	ctx, span := tracing.Start(ctx, "UsageData")
+	defer func() { tracing.End(span, err) }()
+
+	logging.FromContext(ctx).Info("GET usage")
+	return store.Usage(ctx)
+}
+
+// log the ad data get from client, the sensitive headers are redacted
+func printLogPostRequest(logger *slog.Logger, msg string, ad AdData) {
+	logger.Info(msg,
+		"client_ip", ad.ClientIP,
+		logging.Headers(ad.Headers),
+		slog.Group("ad",
+			"title", ad.Ad.Title,
+			"startAt", ad.Ad.StartAt,
+			"endAt", ad.Ad.EndAt,
+			"conditions", ad.Ad.Conditions,
+			"schedule", ad.Ad.Schedule,
+		),
+	)
+}
+
+// log the query requirement from client, the sensitive headers are redacted
+func printLogGetRequest(logger *slog.Logger, query QueryRequest) {
+	requirement := []any{
+		"offset", query.Offset,
+		"limit", query.Limit,
+		"age", query.Age,
+		"gender", query.Gender,
+		"country", query.Country,
+		"platform", query.Platform,
+	}
+	if query.After != nil {
+		requirement = append(requirement, "after", slog.GroupValue(slog.Time("endAt", query.After.EndAt), slog.String("id", query.After.ID)))
+	}
+	logger.Info("GET ads",
+		"client_ip", query.ClientIP,
+		logging.Headers(query.Headers),
+		slog.Group("query", requirement...),
+	)
+}
@@ -0,0 +1,1249 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"dcard/logging"
+	"dcard/storage"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// test storedata
+func TestStoreData(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:      "test AD",
+		StartAt:    time.Now(),
+		EndAt:      time.Now(),
+		Conditions: []storage.Condition{},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	id, err := storage.StoreData(context.Background(), store, test_ad)
+	if err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// query to check if test ad is in the store
+	result, err := store.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Failed to find test ad in the store: %v", err)
+	}
+	assert.Equal(t, test_ad.Ad.Title, result.Title)
+	assert.Equal(t, id, result.ID)
+}
+
+// test the requests are logged with the logger of the request, and the sensitive headers are redacted
+func TestStoreData_Log(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := logging.WithLogger(context.Background(), logging.New(&buf, "info").With("request_id", "abc-123"))
+	store := storage.NewMemoryStore()
+
+	_, err := storage.StoreData(ctx, store, storage.AdData{
+		ClientIP: "127.0.0.1",
+		Headers:  map[string][]string{"Authorization": {"Bearer secret"}, "User-Agent": {"curl/7.88.1"}},
+		Ad:       storage.File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)},
+	})
+	assert.NoError(t, err)
+	_, err = storage.QueryData(ctx, store, storage.QueryRequest{Limit: 5, Headers: map[string][]string{"Cookie": {"session=secret"}}})
+	assert.NoError(t, err)
+
+	log := buf.String()
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte(`"request_id":"abc-123"`)))
+	assert.Contains(t, log, `"msg":"POST ad"`)
+	assert.Contains(t, log, `"title":"test AD"`)
+	assert.Contains(t, log, `"msg":"GET ads"`)
+	assert.Contains(t, log, `"User-Agent":["curl/7.88.1"]`)
+	assert.NotContains(t, log, "secret")
+}
+
+// test every helper runs in a span under the span of the request, and a failed call fails its span
+func TestQueryData_Trace(t *testing.T) {
+	recorder := storage.RecordSpans(t)
+	store := storage.NewMemoryStore()
+	ctx, request := otel.Tracer("test").Start(context.Background(), "test request")
+
+	_, err := storage.StoreData(ctx, store, storage.AdData{Ad: storage.File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)}})
+	assert.NoError(t, err)
+	results, err := storage.QueryData(ctx, store, storage.QueryRequest{Limit: 5})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	_, err = storage.GetData(ctx, store, "not-exist")
+	assert.Error(t, err)
+	request.End()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"StoreData", "QueryData", "GetData"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, request.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+		}
+	}
+
+	// the go-side sort of the memory store is a child of the query
+	if assert.Contains(t, spans, "sort ads") {
+		assert.Equal(t, spans["QueryData"].SpanContext().SpanID(), spans["sort ads"].Parent().SpanID())
+	}
+	assert.Contains(t, spans["QueryData"].Attributes(), attribute.Int("ads.count", 1))
+	assert.Equal(t, codes.Unset, spans["QueryData"].Status().Code)
+	assert.Equal(t, codes.Error, spans["GetData"].Status().Code)
+}
+
+// test query with offset
+func TestQuery_Offset(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file0 := &storage.File{
+		Title:   "test AD0",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file1 := &storage.File{
+		Title:   "test AD1",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file2 := &storage.File{
+		Title:   "test AD2",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad0 := storage.AdData{
+		Ad: *test_file0,
+	}
+	test_ad1 := storage.AdData{
+		Ad: *test_file1,
+	}
+	test_ad2 := storage.AdData{
+		Ad: *test_file2,
+	}
+
+	// insert three test ads
+	if _, err := storage.StoreData(context.Background(), store, test_ad0); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad1); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad2); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   1,
+		Limit:    5,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in offset in query: %v", err)
+	}
+
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, test_ad1.Ad.Title, result[0].Title)
+	assert.Equal(t, test_ad2.Ad.Title, result[1].Title)
+}
+func TestQuery_Offset_TooMuch(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file0 := &storage.File{
+		Title:   "test AD0",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file1 := &storage.File{
+		Title:   "test AD1",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file2 := &storage.File{
+		Title:   "test AD2",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad0 := storage.AdData{
+		Ad: *test_file0,
+	}
+	test_ad1 := storage.AdData{
+		Ad: *test_file1,
+	}
+	test_ad2 := storage.AdData{
+		Ad: *test_file2,
+	}
+
+	// insert three test ads
+	if _, err := storage.StoreData(context.Background(), store, test_ad0); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad1); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad2); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   4,
+		Limit:    5,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	_, err := storage.QueryData(context.Background(), store, query)
+	if err == nil {
+		t.Fatalf("Failed with query in offset too much in query: %v", err)
+	}
+	assert.Equal(t, storage.ErrOffsetOutOfRange, err)
+}
+
+// test query with limit
+func TestQuery_Limit(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file0 := &storage.File{
+		Title:   "test AD0",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file1 := &storage.File{
+		Title:   "test AD1",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file2 := &storage.File{
+		Title:   "test AD2",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad0 := storage.AdData{
+		Ad: *test_file0,
+	}
+	test_ad1 := storage.AdData{
+		Ad: *test_file1,
+	}
+	test_ad2 := storage.AdData{
+		Ad: *test_file2,
+	}
+
+	// insert three test ads
+	if _, err := storage.StoreData(context.Background(), store, test_ad0); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad1); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad2); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   1,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in limit in query: %v", err)
+	}
+
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, test_ad1.Ad.Title, result[0].Title)
+}
+
+// test the result is sort by end time
+func TestQuery_Sort(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file0 := &storage.File{
+		Title:   "test AD0",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 3),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file1 := &storage.File{
+		Title:   "test AD1",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 2),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_file2 := &storage.File{
+		Title:   "test AD2",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad0 := storage.AdData{
+		Ad: *test_file0,
+	}
+	test_ad1 := storage.AdData{
+		Ad: *test_file1,
+	}
+	test_ad2 := storage.AdData{
+		Ad: *test_file2,
+	}
+
+	// insert three test ads
+	if _, err := storage.StoreData(context.Background(), store, test_ad0); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad1); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+	if _, err := storage.StoreData(context.Background(), store, test_ad2); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    3,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in sort in query: %v", err)
+	}
+
+	assert.Equal(t, 3, len(result))
+	assert.Equal(t, test_ad2.Ad.Title, result[0].Title)
+	assert.Equal(t, test_ad1.Ad.Title, result[1].Title)
+	assert.Equal(t, test_ad0.Ad.Title, result[2].Title)
+}
+
+// test query with age
+func TestQueryData_Age_NoLimitInQuery(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 20,
+				AgeEnd:   30,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in age no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Age_NoLimitInDB(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      50,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in age no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Age_BeforeStart(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 20,
+				AgeEnd:   30,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      15,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in age before start in query: %v", err)
+	}
+
+	assert.Equal(t, 0, len(result))
+}
+func TestQueryData_Age_BetweenStartAndEnd(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 20,
+				AgeEnd:   30,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      25,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in age between in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Age_AfterEnd(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 20,
+				AgeEnd:   30,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      35,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in age after end in query: %v", err)
+	}
+
+	assert.Equal(t, 0, len(result))
+}
+
+// test query with gender
+func TestQueryData_Gender_NoLimitInQuery(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   []string{"M", "F"},
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in gender no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Gender_NoLimitInDB(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "F",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in gender no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Gender_ConditionInTestData(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   []string{"M"},
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "M",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in gender in test in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Gender_ConditionNotInTestData(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   []string{"M"},
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "F",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in gender not in test in query: %v", err)
+	}
+
+	assert.Equal(t, 0, len(result))
+}
+
+// test query with country
+func TestQueryData_Country_NoLimtInQuery(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  []string{"TW", "JP"},
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in country no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Country_NoLimtInDB(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "TW",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in country no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Country_ConditionInTestData(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  []string{"TW", "JP"},
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "TW",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in country in test in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Country_ConditionNotInTestData(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  []string{"TW", "JP"},
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "USA",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in country not in test in query: %v", err)
+	}
+
+	assert.Equal(t, 0, len(result))
+}
+
+// test query with platform
+func TestQueryData_Platform_NoLimtInQuery(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: []string{"ios"},
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in platform no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Platform_NoLimtInDB(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: nil,
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "ios",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in platform no limit in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Platform_ConditionInTestData(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: []string{"ios", "MacOS"},
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "MacOS",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in platform in test in query: %v", err)
+	}
+
+	assert.Equal(t, test_ad.Ad.Title, result[0].Title)
+}
+func TestQueryData_Platform_ConditionNotInTestData(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	test_file := &storage.File{
+		Title:   "test AD",
+		StartAt: time.Now(),
+		EndAt:   time.Now().AddDate(0, 0, 1),
+		Conditions: []storage.Condition{
+			{
+				AgeStart: 0,
+				AgeEnd:   0,
+				Gender:   nil,
+				Country:  nil,
+				Platform: []string{"ios"},
+			},
+		},
+	}
+	test_ad := storage.AdData{
+		Ad: *test_file,
+	}
+
+	// insert a test ad
+	if _, err := storage.StoreData(context.Background(), store, test_ad); err != nil {
+		t.Fatalf("Fail to store test ad: %v", err)
+	}
+
+	// set query condition
+	query := storage.QueryRequest{
+		ClientIP: "",
+		Headers:  nil,
+		Offset:   0,
+		Limit:    1,
+		Age:      0,
+		Gender:   "",
+		Country:  "",
+		Platform: "MacOS",
+	}
+
+	// go to query
+	result, err := storage.QueryData(context.Background(), store, query)
+	if err != nil {
+		t.Fatalf("Failed with query in platform not in test in query: %v", err)
+	}
+
+	assert.Equal(t, 0, len(result))
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// define the kind of a change on an ad
+type ChangeOp int
+
+const (
+	ChangeUpsert ChangeOp = iota
+	ChangeDelete
+)
+
+// define a change on an ad seen by a watcher, an upsert carries the whole ad
+type Change struct {
+	Op ChangeOp
+	ID string
+	Ad File
+}
+
+// define a source of the changes made through any server, watch blocks until the context is done,
+// apply is called on every change and reload when the changes can not be followed one by one
+type Watcher interface {
+	Watch(ctx context.Context, apply func(Change), reload func()) error
+}
+
+// the code of the error returned by a standalone mongod when a change stream is opened
+const changeStreamUnsupported = 40573
+
+// the error returned when the change stream is invalidated, for example when the collection is dropped
+var errStreamInvalidated = errors.New("the change stream is invalidated")
+
+// define the watcher on the ads collection, it follows the change stream and polls when change streams are not supported
+type MongoWatcher struct {
+	client       *MgoClient
+	pollInterval time.Duration
+}
+
+var _ Watcher = (*MongoWatcher)(nil)
+
+// establish a watcher on the ads collection of the mongo-client
+func NewMongoWatcher(client *MgoClient, pollInterval time.Duration) *MongoWatcher {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	return &MongoWatcher{client: client, pollInterval: pollInterval}
+}
+
+// follow the change stream until the context is done, a broken stream is resumed from the last change
+func (w *MongoWatcher) Watch(ctx context.Context, apply func(Change), reload func()) error {
+	var token bson.Raw
+	for {
+		opened, err := w.watchStream(ctx, &token, apply, reload)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !opened && isChangeStreamUnsupported(err) {
+			slog.Warn("Change streams are not supported, poll the ads", "interval", w.pollInterval)
+			return w.poll(ctx, reload)
+		}
+		slog.Warn("The change stream of the ads is broken", "err", err)
+
+		// the stream can not be resumed, so the changes during the gap are only seen by loading again
+		if !opened {
+			token = nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.pollInterval):
+		}
+	}
+}
+
+// open the change stream after the token and apply its changes, opened tells if the stream was opened at all
+func (w *MongoWatcher) watchStream(ctx context.Context, token *bson.Raw, apply func(Change), reload func()) (bool, error) {
+	streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if *token != nil {
+		streamOptions.SetResumeAfter(*token)
+	}
+	stream, err := w.client.collection.Watch(ctx, mongo.Pipeline{}, streamOptions)
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close(context.Background())
+
+	// the changes before a new stream is opened are missed, so load everything once it is open
+	if *token == nil {
+		reload()
+	}
+
+	for stream.Next(ctx) {
+		var event struct {
+			OperationType string `bson:"operationType"`
+			FullDocument  *File  `bson:"fullDocument"`
+			DocumentKey   struct {
+				ID primitive.ObjectID `bson:"_id"`
+			} `bson:"documentKey"`
+		}
+		// the token moves past the event first, so an event which can not be decoded is not resumed from forever
+		*token = stream.ResumeToken()
+		if err := stream.Decode(&event); err != nil {
+			// the changed ad is unknown, so load everything again
+			slog.Warn("Fail to decode a change of the ads, reload them", "err", err)
+			reload()
+			continue
+		}
+
+		id := event.DocumentKey.ID.Hex()
+		switch event.OperationType {
+		case "insert", "update", "replace":
+			// the ad looked up for an update may already be deleted
+			if event.FullDocument == nil {
+				apply(Change{Op: ChangeDelete, ID: id})
+			} else {
+				apply(Change{Op: ChangeUpsert, ID: id, Ad: *event.FullDocument})
+			}
+		case "delete":
+			apply(Change{Op: ChangeDelete, ID: id})
+		case "invalidate":
+			*token = nil
+			return true, errStreamInvalidated
+		default:
+			// drop, rename and the others change the collection as a whole
+			reload()
+		}
+	}
+	return true, stream.Err()
+}
+
+// load everything on the interval until the context is done
+func (w *MongoWatcher) poll(ctx context.Context, reload func()) error {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			reload()
+		}
+	}
+}
+
+// check if the error tells the mongod does not support change streams, which needs a replica set
+func isChangeStreamUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(changeStreamUnsupported)
+}
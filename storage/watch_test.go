@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// define a watcher sending the changes and reloads written to its channels, done is sent after each of them
+type chanWatcher struct {
+	changes chan Change
+	reloads chan struct{}
+	done    chan struct{}
+}
+
+func newChanWatcher() *chanWatcher {
+	return &chanWatcher{changes: make(chan Change), reloads: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (w *chanWatcher) Watch(ctx context.Context, apply func(Change), reload func()) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case change := <-w.changes:
+			apply(change)
+		case <-w.reloads:
+			reload()
+		}
+		w.done <- struct{}{}
+	}
+}
+
+// send the change and wait until it is applied
+func (w *chanWatcher) send(change Change) {
+	w.changes <- change
+	<-w.done
+}
+
+// ask to reload and wait until it is done
+func (w *chanWatcher) reload() {
+	w.reloads <- struct{}{}
+	<-w.done
+}
+
+// query the titles of the active ads in the cache
+func cachedTitles(t *testing.T, cache *CachedStore) []string {
+	results, err := cache.Query(context.Background(), QueryRequest{Limit: 100})
+	assert.NoError(t, err)
+	titles := make([]string, len(results))
+	for i, result := range results {
+		titles[i] = result.Title
+	}
+	return titles
+}
+
+// wait until the changes are applied and the cache answers the titles
+func eventuallyTitles(t *testing.T, cache *CachedStore, want []string) {
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(want, cachedTitles(t, cache))
+	}, time.Second, 5*time.Millisecond, "want %v", want)
+}
+
+// test the changes made through another server are applied to the cache
+func TestCachedStore_Watch(t *testing.T) {
+	// two servers share the backend, and the second one watches the writes of the first one
+	backend := NewMemoryStore()
+	first, err := NewCachedStore(context.Background(), backend, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewCachedStore(context.Background(), backend, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	watcher := newChanWatcher()
+	second.Watch(watcher)
+
+	// insert
+	ad := File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)}
+	id, err := first.Insert(context.Background(), ad)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, cachedTitles(t, second))
+	watcher.send(Change{Op: ChangeUpsert, ID: id, Ad: ad})
+	eventuallyTitles(t, second, []string{"test AD"})
+
+	// update
+	ad.Title = "test AD updated"
+	assert.NoError(t, first.Update(context.Background(), id, ad))
+	watcher.send(Change{Op: ChangeUpsert, ID: id, Ad: ad})
+	eventuallyTitles(t, second, []string{"test AD updated"})
+
+	// delete
+	assert.NoError(t, first.Delete(context.Background(), id))
+	watcher.send(Change{Op: ChangeDelete, ID: id})
+	eventuallyTitles(t, second, []string{})
+
+	// reload
+	_, err = first.Insert(context.Background(), File{Title: "test AD2", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	watcher.reload()
+	assert.Equal(t, []string{"test AD2"}, cachedTitles(t, second))
+}
+
+// test apply keeps the snapshot sorted and drops the ended ads
+func TestCachedStore_Apply(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	cache, _ := newTestCachedStore(t, 0, WithClock(clock))
+	now := clock.Now()
+
+	cache.Apply(Change{Op: ChangeUpsert, ID: "b", Ad: File{Title: "test AD b", EndAt: now.Add(2 * time.Hour)}})
+	cache.Apply(Change{Op: ChangeUpsert, ID: "a", Ad: File{Title: "test AD a", EndAt: now.Add(3 * time.Hour)}})
+	cache.Apply(Change{Op: ChangeUpsert, ID: "c", Ad: File{Title: "test AD c", EndAt: now.Add(time.Hour)}})
+	assert.Equal(t, []string{"test AD c", "test AD b", "test AD a"}, cachedTitles(t, cache))
+
+	// an update moves the ad to its new place
+	cache.Apply(Change{Op: ChangeUpsert, ID: "c", Ad: File{Title: "test AD c", EndAt: now.Add(4 * time.Hour)}})
+	assert.Equal(t, []string{"test AD b", "test AD a", "test AD c"}, cachedTitles(t, cache))
+
+	// an ad updated to end in the past is removed, and so is a deleted one
+	cache.Apply(Change{Op: ChangeUpsert, ID: "a", Ad: File{Title: "test AD a", EndAt: now}})
+	cache.Apply(Change{Op: ChangeDelete, ID: "b"})
+	cache.Apply(Change{Op: ChangeDelete, ID: "not-exist"})
+	assert.Equal(t, []string{"test AD c"}, cachedTitles(t, cache))
+
+	// the last change of an ad in a batch wins
+	cache.Apply(
+		Change{Op: ChangeUpsert, ID: "d", Ad: File{Title: "test AD d", EndAt: now.Add(time.Hour)}},
+		Change{Op: ChangeDelete, ID: "c"},
+		Change{Op: ChangeUpsert, ID: "c", Ad: File{Title: "test AD c moved", EndAt: now.Add(30 * time.Minute)}},
+		Change{Op: ChangeUpsert, ID: "e", Ad: File{Title: "test AD e", EndAt: now.Add(5 * time.Hour)}},
+		Change{Op: ChangeDelete, ID: "e"},
+	)
+	assert.Equal(t, []string{"test AD c moved", "test AD d"}, cachedTitles(t, cache))
+}
+
+// test a burst of changes seen by the watcher is applied by a few rebuilds of the index instead of one each
+func TestCachedStore_ApplyBurst(t *testing.T) {
+	recorder := recordSpans(t)
+	cache, _ := newTestCachedStore(t, 0)
+	watcher := newChanWatcher()
+	cache.Watch(watcher)
+
+	want := make([]string, 100)
+	for i := range want {
+		want[i] = fmt.Sprintf("test AD %02d", i)
+		watcher.send(Change{Op: ChangeUpsert, ID: want[i], Ad: File{Title: want[i], EndAt: time.Now().Add(time.Duration(i+1) * time.Minute)}})
+	}
+	eventuallyTitles(t, cache, want)
+
+	rebuilds := 0
+	for _, span := range recorder.Ended() {
+		if span.Name() == "apply changes" {
+			rebuilds++
+		}
+	}
+	assert.Less(t, rebuilds, 10)
+}
+
+// test close stops the watcher
+func TestCachedStore_CloseWatch(t *testing.T) {
+	cache, err := NewCachedStore(context.Background(), NewMemoryStore(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Watch(newChanWatcher())
+
+	closed := make(chan struct{})
+	go func() {
+		cache.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the watcher is not stopped by close")
+	}
+}
+
+// test a standalone mongod is told apart by its error code
+func TestIsChangeStreamUnsupported(t *testing.T) {
+	err := mongo.CommandError{Code: changeStreamUnsupported, Message: "The $changeStream stage is only supported on replica sets"}
+	assert.True(t, isChangeStreamUnsupported(err))
+	assert.True(t, isChangeStreamUnsupported(fmt.Errorf("watch: %w", err)))
+	assert.False(t, isChangeStreamUnsupported(mongo.CommandError{Code: 11000}))
+	assert.False(t, isChangeStreamUnsupported(errors.New("connection refused")))
+	assert.False(t, isChangeStreamUnsupported(nil))
+}
+
+// test the cache sees the ads written to mongodb by another server, by the change stream or by polling
+func TestMongoWatcher(t *testing.T) {
+	store := newTestMongoStore(t)
+	cache, err := NewCachedStore(context.Background(), store, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.Watch(NewMongoWatcher(store.client, 50*time.Millisecond))
+
+	// write behind the cache
+	id, err := store.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		titles := cachedTitles(t, cache)
+		return len(titles) == 1 && titles[0] == "test AD"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, store.Delete(context.Background(), id))
+	assert.Eventually(t, func() bool {
+		return len(cachedTitles(t, cache)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// test an event which can not be decoded makes the cache reload, and the changes after it are still seen
+func TestMongoWatcher_BadEvent(t *testing.T) {
+	store := newTestMongoStore(t)
+	cache, err := NewCachedStore(context.Background(), store, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.Watch(NewMongoWatcher(store.client, 50*time.Millisecond))
+
+	// a title which is not a string can not be decoded into an ad, it is removed so the reload succeeds
+	result, err := store.client.collection.InsertOne(context.Background(), bson.M{"title": 5, "endat": time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.client.collection.DeleteOne(context.Background(), bson.M{"_id": result.InsertedID})
+	assert.NoError(t, err)
+
+	_, err = store.Insert(context.Background(), File{Title: "test AD", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		titles := cachedTitles(t, cache)
+		return len(titles) == 1 && titles[0] == "test AD"
+	}, 5*time.Second, 10*time.Millisecond)
+}
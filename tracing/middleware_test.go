@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// establish a router whose handler starts a child span and answers with the status in the path
+func newTestRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/test-trace/:status", func(c *gin.Context) {
+		_, span := Start(c.Request.Context(), "test handler")
+		End(span, nil)
+		switch c.Param("status") {
+		case "500":
+			c.Status(http.StatusInternalServerError)
+		case "404":
+			c.Status(http.StatusNotFound)
+		default:
+			c.Status(http.StatusOK)
+		}
+	})
+	return router
+}
+
+// get the value of the attribute on the span
+func spanAttribute(attrs []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// test the server span continues the trace of the client, and the spans of the handler are its children
+func TestMiddleware_Propagate(t *testing.T) {
+	recorder := recordSpans(t)
+	router := newTestRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/test-trace/200", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	handler, server := spans[0], spans[1]
+	assert.Equal(t, "GET /test-trace/:status", server.Name())
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.True(t, server.Parent().IsRemote())
+	assert.Equal(t, "/test-trace/:status", spanAttribute(server.Attributes(), "http.route").AsString())
+	assert.Equal(t, int64(http.StatusOK), spanAttribute(server.Attributes(), "http.response.status_code").AsInt64())
+	assert.Equal(t, server.SpanContext().SpanID(), handler.Parent().SpanID())
+}
+
+// test a new trace is started without a traceparent, and only a server error fails the span
+func TestMiddleware_Status(t *testing.T) {
+	recorder := recordSpans(t)
+	router := newTestRouter()
+
+	for _, c := range []struct {
+		path string
+		code codes.Code
+	}{
+		{"/test-trace/500", codes.Error},
+		{"/test-trace/404", codes.Unset},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.path, nil))
+		spans := recorder.Ended()
+		server := spans[len(spans)-1]
+		assert.False(t, server.Parent().IsValid())
+		assert.Equal(t, c.code, server.Status().Code, c.path)
+	}
+
+	// a request matching no route is named by its method
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/not-exist", nil))
+	spans := recorder.Ended()
+	assert.Equal(t, "GET", spans[len(spans)-1].Name())
+}
@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// record the spans ended during the test, every trace is sampled and the trace context is propagated
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+// restore the global tracer provider and propagator changed by setup after the test
+func restoreGlobals(t *testing.T) {
+	previous, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(propagator)
+	})
+}
+
+// test the spans are appended to the file by the file exporter when it is shut down
+func TestSetup_File(t *testing.T) {
+	restoreGlobals(t)
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(context.Background(), Options{Exporter: ExporterFile, File: path, SampleRatio: 1, ServiceName: "test-ads"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := Start(context.Background(), "test parent")
+	_, child := Start(ctx, "test child")
+	End(child, nil)
+	End(parent, nil)
+	assert.NoError(t, shutdown(context.Background()))
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(b), `"Name":"test parent"`)
+	assert.Contains(t, string(b), `"Name":"test child"`)
+	assert.Contains(t, string(b), `"Value":"test-ads"`)
+}
+
+// test nothing is sampled with a zero ratio
+func TestSetup_SampleRatio(t *testing.T) {
+	restoreGlobals(t)
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(context.Background(), Options{Exporter: ExporterFile, File: path, SampleRatio: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "test span")
+	assert.False(t, span.IsRecording())
+	End(span, nil)
+	assert.NoError(t, shutdown(context.Background()))
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, b)
+}
+
+// test no exporter is established for none, and an unknown exporter is an error
+func TestSetup_Exporter(t *testing.T) {
+	restoreGlobals(t)
+	shutdown, err := Setup(context.Background(), Options{Exporter: ExporterNone})
+	if assert.NoError(t, err) {
+		assert.NoError(t, shutdown(context.Background()))
+	}
+
+	shutdown, err = Setup(context.Background(), Options{Exporter: ExporterOTLP, Endpoint: "http://127.0.0.1:4318", SampleRatio: 1})
+	if assert.NoError(t, err) {
+		assert.NoError(t, shutdown(context.Background()))
+	}
+
+	_, err = Setup(context.Background(), Options{Exporter: "zipkin"})
+	assert.Error(t, err)
+}
+
+// test end records the error and fails the span
+func TestEnd(t *testing.T) {
+	recorder := recordSpans(t)
+
+	ctx, parent := Start(context.Background(), "test parent")
+	_, child := StartClient(ctx, "test client")
+	End(child, errors.New("test error"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, "test client", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "test error", spans[0].Status().Description)
+	if assert.Len(t, spans[0].Events(), 1) {
+		assert.Equal(t, "exception", spans[0].Events()[0].Name)
+	}
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+}